@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+)
+
+// isFailure tells whether result of a recorded run counts as failure for --alert-after.
+func isFailure(result string) bool {
+	return result == monitorCritical.String() || result == monitorUnknown.String()
+}
+
+// consecutiveFailures counts the failed runs at the end of records.
+func consecutiveFailures(records []RunRecord) uint {
+	var n uint
+	for i := len(records) - 1; i >= 0 && isFailure(records[i].Result); i-- {
+		n++
+	}
+	return n
+}
+
+// alertState decides which state to report to monitoring for this run
+// and whether to report at all. Failures are only reported after
+// --alert-after consecutive failures, including this run.
+// Until then they are reported as WARNING with --warn-before-alert
+// or not at all. Results other than failures are always reported.
+func alertState(state monitoringResult) (monitoringResult, bool) {
+	if opts.AlertAfter <= 1 || !isFailure(state.String()) {
+		return state, true
+	}
+
+	records, err := loadHistory(historyFile())
+	if err != nil {
+		// rather alert too often than miss a failure
+		log.Println("ERROR: cannot read run history:", err)
+		return state, true
+	}
+
+	failures := consecutiveFailures(records) + 1
+	if failures >= opts.AlertAfter {
+		return state, true
+	}
+
+	log.Printf("INFO: failure %d of %d before alerting\n", failures, opts.AlertAfter)
+	if opts.WarnBeforeAlert {
+		return monitorWarning, true
+	}
+	return state, false
+}
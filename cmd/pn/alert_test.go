@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestConsecutiveFailures(t *testing.T) {
+	records := []RunRecord{
+		{Result: "CRITICAL"},
+		{Result: "OK"},
+		{Result: "UNKNOWN"},
+		{Result: "CRITICAL"},
+	}
+	if got := consecutiveFailures(records); got != 2 {
+		t.Errorf("got %d, want 2", got)
+	}
+	if got := consecutiveFailures(nil); got != 0 {
+		t.Errorf("got %d, want 0", got)
+	}
+}
+
+func TestAlertAfter(t *testing.T) {
+	oldopts := opts
+	oldEvent := monitoringEvent
+	defer func() {
+		opts = oldopts
+		monitoringEvent = oldEvent
+	}()
+
+	dir, err := ioutil.TempDir("", "pnalert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts.StateDir = dir
+	opts.AlertAfter = 3
+	monitoringEvent = "TestAlertAfter"
+	if err := privateSubdir(historyDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		previous string
+		warn     bool
+		state    monitoringResult
+		want     monitoringResult
+		alert    bool
+	}{
+		// first failure: not yet
+		{"OK", false, monitorCritical, monitorCritical, false},
+		{"OK", true, monitorCritical, monitorWarning, true},
+		// second failure: not yet
+		{"CRITICAL", false, monitorUnknown, monitorUnknown, false},
+		// third failure: alert
+		{"CRITICAL", false, monitorCritical, monitorCritical, true},
+		// recovery: always
+		{"CRITICAL", false, monitorOk, monitorOk, true},
+		// and still alerting
+		{"OK", false, monitorOk, monitorOk, true},
+	}
+
+	for i, tc := range tests {
+		if err := appendHistory(historyFile(), RunRecord{Result: tc.previous}); err != nil {
+			t.Fatal(err)
+		}
+		opts.WarnBeforeAlert = tc.warn
+
+		got, alert := alertState(tc.state)
+		if got != tc.want || alert != tc.alert {
+			t.Errorf("%d: got %s/%v, want %s/%v", i, got, alert, tc.want, tc.alert)
+		}
+	}
+}
+
+func TestMonitorSuppressesBeforeAlert(t *testing.T) {
+	oldCalls := monitoringCalls
+	oldEvent := monitoringEvent
+	oldCommander := commander
+	oldOpts := opts
+	defer func() {
+		monitoringCalls = oldCalls
+		monitoringEvent = oldEvent
+		commander = oldCommander
+		opts = oldOpts
+	}()
+
+	dir, err := ioutil.TempDir("", "pnalert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setupMonitoringCalls()
+	opts.StateDir = dir
+	opts.AlertAfter = 2
+	monitoringEvent = "tests"
+	ce := &mockCommanderExecutor{}
+
+	commander = Commander(ce)
+	monitor(monitorCritical, "failed")
+	if ce.got != "" {
+		t.Errorf("want no monitoring call for first failure, got '%v'", ce.got)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Jimdo/periodicnoise/syslog"
 	"github.com/vaughan0/go-ini"
 )
 
@@ -36,21 +41,279 @@ func fillMonitoringCommands(config ini.File) {
 	}
 }
 
+func fillNSCA(config ini.File) error {
+	if host, ok := config.Get("monitoring", "nsca_host"); ok {
+		nsca.Host = host
+	}
+	if port, ok := config.Get("monitoring", "nsca_port"); ok {
+		nsca.Port = port
+	}
+	if password, ok := config.Get("monitoring", "nsca_password"); ok {
+		nsca.Password = password
+	}
+	if encryption, ok := config.Get("monitoring", "nsca_encryption"); ok {
+		method, err := ParseNSCAEncryption(encryption)
+		if err != nil {
+			return err
+		}
+		nsca.Encryption = method
+	}
+	if s, ok := config.Get("monitoring", "nsca_timeout"); ok {
+		timeout, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		nsca.Timeout = timeout
+	}
+	return nil
+}
+
+func fillWebhook(config ini.File) error {
+	for key, value := range config.Section("webhook") {
+		switch {
+		case key == "url":
+			webhook.URL = value
+		case key == "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			webhook.Timeout = timeout
+		case key == "retries":
+			retries, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return err
+			}
+			webhook.Retries = uint(retries)
+		case strings.HasPrefix(key, "header."):
+			webhook.Headers[strings.TrimPrefix(key, "header.")] = value
+		}
+	}
+	return nil
+}
+
+func fillMetrics(config ini.File) error {
+	if dir, ok := config.Get("metrics", "textfile_dir"); ok {
+		textfile.Dir = dir
+	}
+	return nil
+}
+
+func fillPushgateway(config ini.File) error {
+	if u, ok := config.Get("pushgateway", "url"); ok {
+		pushgateway.URL = u
+	}
+	if s, ok := config.Get("pushgateway", "timeout"); ok {
+		timeout, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		pushgateway.Timeout = timeout
+	}
+	return nil
+}
+
+func fillStatsd(config ini.File) error {
+	if address, ok := config.Get("statsd", "address"); ok {
+		statsd.Address = address
+	}
+	if prefix, ok := config.Get("statsd", "prefix"); ok {
+		statsd.Prefix = prefix
+	}
+	if s, ok := config.Get("statsd", "dogstatsd"); ok {
+		dogstatsd, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		statsd.DogStatsD = dogstatsd
+	}
+	return nil
+}
+
+func fillLock(config ini.File) error {
+	if dir, ok := config.Get("lock", "dir"); ok {
+		lockConfig.Dir = dir
+	}
+	if name, ok := config.Get("lock", "name"); ok {
+		if err := validLockName(name); err != nil {
+			return err
+		}
+		lockConfig.Name = name
+	}
+	if dir, ok := config.Get("lock", "lease_dir"); ok {
+		if err := leaseConflict(opts.KillRunning); err != nil {
+			return err
+		}
+		lockConfig.LeaseDir = dir
+	}
+	if s, ok := config.Get("lock", "lease_ttl"); ok {
+		ttl, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		lockConfig.LeaseTTL = ttl
+	}
+	return nil
+}
+
+// fillSeverity sets the syslog severity of a stream or level of our own messages
+func fillSeverity(name, value string) error {
+	if _, ok := logSeverities[name]; !ok {
+		return fmt.Errorf("unknown syslog severity setting severity.%s, want one of stdout, stderr, fatal, error, warning, info", name)
+	}
+	severity, err := syslog.ParseSeverity(value)
+	if err != nil {
+		return err
+	}
+	logSeverities[name] = severity
+	return nil
+}
+
+func fillSyslog(config ini.File) error {
+	for key, value := range config.Section("syslog") {
+		switch key {
+		case "network":
+			logNetwork = value
+		case "address":
+			logRemoteAddress = value
+		case "ca_file":
+			syslogTLS.CAFile = value
+		case "cert_file":
+			syslogTLS.CertFile = value
+		case "key_file":
+			syslogTLS.KeyFile = value
+		case "framing":
+			framing, err := syslog.ParseFraming(value)
+			if err != nil {
+				return err
+			}
+			logFraming = &framing
+		case "queue_size":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			logQueueSize = size
+		case "spool":
+			spool, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			logSpool = spool
+		case "sd_id":
+			if err := validSDID(value); err != nil {
+				return err
+			}
+			sdID = value
+		default:
+			if strings.HasPrefix(key, "severity.") {
+				if err := fillSeverity(strings.TrimPrefix(key, "severity."), value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// configKey locates a setting in our config
+type configKey struct {
+	section, key string
+}
+
+// failure handling of backends by backend name
+var failureModeKeys = map[string]configKey{
+	"commands":    {"monitoring", "on_failure"},
+	"nsca":        {"monitoring", "nsca_on_failure"},
+	"webhook":     {"webhook", "on_failure"},
+	"textfile":    {"metrics", "on_failure"},
+	"pushgateway": {"pushgateway", "on_failure"},
+	"statsd":      {"statsd", "on_failure"},
+}
+
+func fillFailureModes(config ini.File) error {
+	for name, k := range failureModeKeys {
+		if s, ok := config.Get(k.section, k.key); ok {
+			mode, err := parseFailureMode(s)
+			if err != nil {
+				return err
+			}
+			backendFailureModes[name] = mode
+		}
+	}
+	return nil
+}
+
+// fillConfig reads all settings from config, overriding the ones read before.
+func fillConfig(config ini.File) error {
+	fillMonitoringCommands(config)
+	for _, fill := range []func(ini.File) error{
+		fillNSCA,
+		fillWebhook,
+		fillMetrics,
+		fillPushgateway,
+		fillStatsd,
+		fillSyslog,
+		fillLock,
+		fillFailureModes,
+	} {
+		if err := fill(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadLockConfig reads only the lock section of global and per user config,
+// e.g. for "pn status".
+func loadLockConfig() error {
+	for _, name := range []string{GlobalConfig, filepath.Join(os.Getenv("HOME"), UserConfig)} {
+		config, err := loadConfig(name)
+		if err == nil {
+			err = fillLock(config)
+		}
+		if err != nil {
+			return fmt.Errorf("reading config %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
 // Load monitoring commands from config
 func loadMonitoringCommands() {
 	global, err := loadConfig(GlobalConfig)
+	if err == nil {
+		err = fillConfig(global)
+	}
 	if err != nil {
 		log.Fatalln("ERROR: reading global config: ", err)
 		return
 	}
-	fillMonitoringCommands(global)
 
 	home := os.Getenv("HOME")
 
 	user, err := loadConfig(filepath.Join(home, UserConfig))
+	if err == nil {
+		err = fillConfig(user)
+	}
 	if err != nil {
 		log.Fatalf("ERROR: reading per user config: %#v", err)
 		return
 	}
-	fillMonitoringCommands(user)
+
+	if nsca.Enabled() {
+		monitoringBackends = append(monitoringBackends, namedBackend{"nsca", &nsca})
+	}
+	if webhook.Enabled() {
+		monitoringBackends = append(monitoringBackends, namedBackend{"webhook", &webhook})
+	}
+	if textfile.Enabled() {
+		metricsBackends = append(metricsBackends, namedBackend{"textfile", &textfile})
+	}
+	if pushgateway.Enabled() {
+		metricsBackends = append(metricsBackends, namedBackend{"pushgateway", &pushgateway})
+	}
+	if statsd.Enabled() {
+		metricsBackends = append(metricsBackends, namedBackend{"statsd", &statsd})
+	}
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"math/rand"
@@ -24,22 +26,98 @@ func disableTimer(timer *time.Timer) *time.Timer {
 	return nil
 }
 
+// ScatterDelay chooses how long to delay the start of the command.
+// The delay is random within maxDelay, unless --scatter-by-host is given.
+// Then every host gets a fixed slot within maxDelay for each monitoring event.
+func ScatterDelay(maxDelay time.Duration) time.Duration {
+	if maxDelay <= 0 {
+		return 0
+	}
+	if opts.ScatterByHost {
+		hostname, _ := os.Hostname()
+		return hostScatterDelay(hostname, monitoringEvent, maxDelay)
+	}
+	// Seed random generator with current process ID
+	rand.Seed(int64(os.Getpid()))
+	return time.Duration(rand.Int63n(int64(maxDelay)))
+}
+
+// hostScatterDelay spreads hosts evenly within maxDelay by hashing
+// hostname and event, so the same host always gets the same delay.
+func hostScatterDelay(hostname, event string, maxDelay time.Duration) time.Duration {
+	h := fnv.New64a()
+	io.WriteString(h, hostname)
+	// separate hostname and event, so "ab"+"c" and "a"+"bc" differ
+	h.Write([]byte{0})
+	io.WriteString(h, event)
+	return time.Duration(h.Sum64() % uint64(maxDelay))
+}
+
 // ScatterWait avoids the thundering herd problem
 // on remote services used by this command.
 // Set maxDelay to 0, if this is not an issue.
 func ScatterWait(maxDelay time.Duration) {
-	if maxDelay > 0 {
-		// Seed random generator with current process ID
-		rand.Seed(int64(os.Getpid()))
-		// Sleep for random amount of time within maxDelay
-		time.Sleep(time.Duration(rand.Int63n(int64(maxDelay))))
+	if delay := ScatterDelay(maxDelay); delay > 0 {
+		log.Println("INFO: delaying start by", delay)
+		time.Sleep(delay)
+	}
+}
+
+// retryRand provides the jitter for waits between retries.
+var retryRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// RetryDelay computes how long to wait before the given retry, counting from 1.
+// The wait grows by --retry-backoff-factor with each retry up to --retry-max-delay
+// and is shortened randomly by up to --retry-jitter of its length.
+func RetryDelay(retry uint) time.Duration {
+	delay := float64(opts.RetryDelay)
+	limit := float64(opts.RetryMaxDelay)
+	for i := uint(1); i < retry; i++ {
+		delay *= opts.RetryBackoff
+		if limit > 0 && delay >= limit {
+			break
+		}
+	}
+	if limit > 0 && delay > limit {
+		delay = limit
+	}
+	if opts.RetryJitter > 0 {
+		delay -= delay * opts.RetryJitter * retryRand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// graceTime returns how long before the deadline the command gets GracefulSignal.
+// It is 0, if --grace-time leaves no time for the command at all.
+func graceTime() time.Duration {
+	if opts.GraceTime >= opts.Timeout {
+		return 0
 	}
+	return opts.GraceTime
 }
 
 // CoreLoopRetry encapsulates retries, so flaky commands can be handled, too.
+// The start is scattered only once before the first attempt,
+// retries are spaced by RetryDelay instead.
+// Start delay, all attempts and waits between them share the budget of opts.Timeout.
 func CoreLoopRetry(args []string, logger io.Writer) (err error) {
+	deadline := time.Now().Add(opts.Timeout)
+	ScatterWait(opts.MaxDelay)
+
 	for i := uint(0); i < opts.Retries+1; i++ {
-		err = CoreLoopOnce(args, logger)
+		if i > 0 {
+			wait := RetryDelay(i)
+			// an attempt needs more than the grace time, or it would be terminated right away
+			if deadline.Sub(time.Now().Add(wait)) <= graceTime() {
+				log.Printf("INFO: no time left for retry %d of %d, giving up\n", i, opts.Retries)
+				return err
+			}
+			log.Printf("INFO: waiting %s before retry %d of %d\n", wait, i, opts.Retries)
+			time.Sleep(wait)
+		}
+
+		currentRun.Attempts = i + 1
+		err = CoreLoopUntil(args, logger, deadline)
 		if err == nil {
 			return nil
 		}
@@ -50,36 +128,109 @@ func CoreLoopRetry(args []string, logger io.Writer) (err error) {
 				return nil
 			}
 		}
+
+		if !shouldRetry(err) {
+			if i < opts.Retries {
+				log.Printf("INFO: not retrying after %s failure: %s\n", errorClass(err), err)
+			}
+			return err
+		}
 	}
 	return err
 }
 
-// CoreLoopOnce handles the core logic of our tool,
+// defaultRetryOn lists the failures to retry, unless --retry-on is given.
+// Retrying cannot help, if the command is not available or still locked.
+var defaultRetryOn = classList{errorClassTimeout, errorClassExit}
+
+// shouldRetry decides whether another attempt might fix err.
+func shouldRetry(err error) bool {
+	class := errorClass(err)
+	// whoever signalled us wants the command to stop
+	if class == errorClassSignal {
+		return false
+	}
+	if class == errorClassExit && len(opts.RetryOnExit) > 0 {
+		code := exitCode(err)
+		for _, c := range opts.RetryOnExit {
+			if int(c) == code {
+				return true
+			}
+		}
+		return false
+	}
+
+	retryOn := opts.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	for _, c := range retryOn {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// killSignalled kills the process tree of cmd, because we have been signalled.
+// It returns false, if there is no process to kill.
+func killSignalled(cmd *exec.Cmd) bool {
+	if grp, _ := ProcessGroup(cmd.Process); KillProcess(grp) == nil {
+		log.Println("INFO: Killed process group, because we have been signalled")
+	} else if KillProcess(cmd.Process) == nil {
+		log.Println("INFO: Killed process, because we have been signalled")
+	} else {
+		// normal case for fast kill
+		log.Println("INFO: Killed before the process even started?")
+		return false
+	}
+	return true
+}
+
+// CoreLoopOnce executes the command once, with opts.Timeout as time budget.
+func CoreLoopOnce(args []string, logger io.Writer) error {
+	return CoreLoopUntil(args, logger, time.Now().Add(opts.Timeout))
+}
+
+// CoreLoopUntil handles the core logic of our tool,
 // Which is:
-//  * wait a random amount of time
 //  * lock top ensure single execution
 //  * stream output
-//  * start timer to limit execution time
+//  * start timer to limit execution time until deadline
 //  * wait for output streams
 //  * free the lock
 //  * report situation via return code
 //  * handles signals
-func CoreLoopOnce(args []string, logger io.Writer) error {
+func CoreLoopUntil(args []string, logger io.Writer, deadline time.Time) error {
 	var wg sync.WaitGroup
 
 	now := time.Now()
-	ScatterWait(opts.MaxDelay)
 
-	lock, err := createLock(opts.KillRunning)
+	var lock Lock
+	var slot uint
+	var err error
+	if opts.LockWait > 0 {
+		// waiting counts against the timeout
+		until := now.Add(opts.LockWait)
+		if deadline.Before(until) {
+			until = deadline
+		}
+		lock, slot, err = waitForLock(until)
+	} else {
+		lock, slot, err = takeLock(opts.KillRunning)
+	}
 	if err != nil {
 		return &LockError{
-			name: string(lock),
+			name: lockPath(),
 			err:  err,
 		}
 	}
 	defer lock.Unlock()
+	defer forgetGroup(lock)
 
 	cmd := exec.Command(args[0], args[1:]...)
+	// lets concurrent instances e.g. pick distinct work directories
+	cmd.Env = append(os.Environ(), fmt.Sprintf("PN_SLOT=%d", slot))
 	err = connectOutputs(cmd, logger, &wg)
 	if err != nil {
 		return err
@@ -87,18 +238,26 @@ func CoreLoopOnce(args []string, logger io.Writer) error {
 
 	// error code channel for asynchronous errors from processLife
 	errc := make(chan error, 1)
-	go processLife(cmd, errc)
+	go processLife(cmd, errc, func(pgid int) { recordGroup(lock, pgid) })
+
+	// retries share the deadline, so later attempts have less time left
+	remaining := deadline.Sub(time.Now())
 
 	// hardlimit provides a hard deadline, after which cmd will not run anymore
-	hardlimit := time.NewTimer(opts.Timeout - time.Since(now))
+	hardlimit := time.NewTimer(remaining)
 
 	//softlimit provides a softer deadline, after which cmd will by signalled,
 	//but has a chance to catch the signal
-	softlimit := time.NewTimer(opts.Timeout - time.Since(now) - opts.GraceTime)
-	if opts.GraceTime == 0 || opts.GraceTime >= opts.Timeout {
+	grace := graceTime()
+	softlimit := time.NewTimer(remaining - grace)
+	if grace == 0 || grace >= remaining {
 		softlimit = disableTimer(softlimit)
 	}
 
+	// killlimit escalates to SIGKILL, if the process tree outlives the grace time after a signal
+	var killlimit *time.Timer
+	var signalled os.Signal
+
 	sigc := ReceiveDeadlySignals()
 	defer IgnoreDeadlySignals(sigc)
 
@@ -110,16 +269,36 @@ func CoreLoopOnce(args []string, logger io.Writer) error {
 			softlimit = disableTimer(softlimit)
 			log.Println("INFO: Received signal", signal)
 
-			if grp, _ := ProcessGroup(cmd.Process); KillProcess(grp) == nil {
-				log.Println("INFO: Killed process group, because we have been signalled")
-			} else if KillProcess(cmd.Process) == nil {
-				log.Println("INFO: Killed process, because we have been signalled")
-			} else {
-				// normal case for fast kill
-				log.Println("INFO: Killed before the process even started?")
-
+			// give the process tree the grace time to terminate, unless signalled again
+			first := signalled == nil
+			signalled = signal
+			if first && opts.GraceTime > 0 {
+				if grp, _ := ProcessGroup(cmd.Process); TerminateProcess(grp) == nil {
+					log.Println("INFO: Terminated process group, because we have been signalled")
+					killlimit = time.NewTimer(opts.GraceTime)
+					break
+				} else if TerminateProcess(cmd.Process) == nil {
+					log.Println("INFO: Terminated process, because we have been signalled")
+					killlimit = time.NewTimer(opts.GraceTime)
+					break
+				}
+			}
+			killlimit = disableTimer(killlimit)
+			if !killSignalled(cmd) {
 				// and we are done here, so terminate the loop
 				errc = nil
+				if err == nil {
+					err = &SignalledError{signal: signal}
+				}
+			}
+		case <-timerChannel(killlimit):
+			killlimit = disableTimer(killlimit)
+			log.Println("INFO: Grace time after signal is over")
+			if !killSignalled(cmd) {
+				errc = nil
+				if err == nil {
+					err = &SignalledError{signal: signalled}
+				}
 			}
 		case cerr := <-errc:
 			// we record only ONE error. Timeouts might set an error before we come here.
@@ -131,8 +310,9 @@ func CoreLoopOnce(args []string, logger io.Writer) error {
 			// and like to leave the for loop now.
 			errc = nil
 
-			// clear timer
+			// clear timers
 			hardlimit = disableTimer(hardlimit)
+			killlimit = disableTimer(killlimit)
 
 			// wait for output streams to finish
 			wg.Wait()
@@ -185,5 +365,9 @@ func CoreLoopOnce(args []string, logger io.Writer) error {
 		}
 	}
 
+	// a command stopped on our behalf didn't fail by itself, so it must not be retried
+	if _, ok := err.(*SignalledError); signalled != nil && err != nil && !ok {
+		return &SignalledError{signal: signalled, err: err}
+	}
 	return err
 }
@@ -8,7 +8,9 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	flags "github.com/jessevdk/go-flags"
 )
@@ -275,3 +277,346 @@ func TestCoreLoopOnceSoftTimeout(t *testing.T) {
 		t.Error("want soft timeout error, got ", err)
 	}
 }
+
+func TestScatterDelayByHost(t *testing.T) {
+	oldopts := opts
+	oldEvent := monitoringEvent
+	defer func() {
+		opts = oldopts
+		monitoringEvent = oldEvent
+	}()
+
+	arguments := "--scatter-by-host --max-start-delay=1h -- true"
+	_, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitoringEvent = "TestScatterDelayByHost"
+
+	first := ScatterDelay(opts.MaxDelay)
+	if first < 0 || first >= opts.MaxDelay {
+		t.Fatalf("want delay within [0, %s), got %s", opts.MaxDelay, first)
+	}
+	if again := ScatterDelay(opts.MaxDelay); again != first {
+		t.Errorf("want same delay %s on every call, got %s", first, again)
+	}
+}
+
+func TestHostScatterDelaySpreadsHosts(t *testing.T) {
+	const hosts = 100
+	maxDelay := time.Hour
+	// hosts starting per minute, evenly spread would use most minutes and
+	// none of them much more than twice as often as on average
+	perMinute := map[time.Duration]int{}
+	for i := 0; i < hosts; i++ {
+		delay := hostScatterDelay(fmt.Sprintf("web%02d.example.com", i), "backup_db", maxDelay)
+		if delay < 0 || delay >= maxDelay {
+			t.Fatalf("want delay within [0, %s), got %s", maxDelay, delay)
+		}
+		perMinute[delay/time.Minute]++
+	}
+	if len(perMinute) < 40 {
+		t.Errorf("want hosts starting in at least 40 of 60 minutes, got %d", len(perMinute))
+	}
+	for minute, n := range perMinute {
+		if n > 6 {
+			t.Errorf("want at most 6 hosts starting per minute, got %d in minute %d", n, minute)
+		}
+	}
+
+	if hostScatterDelay("web01", "backup_db", maxDelay) == hostScatterDelay("web01", "rotate_logs", maxDelay) {
+		t.Error("want different delays for different events on the same host")
+	}
+}
+
+func TestRetryDelayBackoff(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	arguments := "--retry-delay=1s --retry-backoff-factor=3 --retry-max-delay=20s -- true"
+	_, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 20 * time.Second, 20 * time.Second}
+	for i, w := range want {
+		retry := uint(i + 1)
+		if got := RetryDelay(retry); got != w {
+			t.Errorf("retry %d: got %s, want %s", retry, got, w)
+		}
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	arguments := "--retry-delay=1s --retry-jitter=0.5 -- true"
+	_, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if got := RetryDelay(1); got < 500*time.Millisecond || got > time.Second {
+			t.Fatalf("got %s, want between 500ms and 1s", got)
+		}
+	}
+}
+
+func TestCoreLoopRetryStaysInBudget(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	arguments := "--retries=10 --retry-delay=100ms --timeout=500ms -- false"
+	args, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	start := time.Now()
+	err = CoreLoopRetry(args, &bytes.Buffer{})
+	took := time.Since(start)
+	t.Log(output.String())
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Error("want exit error, got", err)
+	}
+	if took > opts.Timeout {
+		t.Errorf("retries took %s, want at most %s", took, opts.Timeout)
+	}
+	if !strings.Contains(output.String(), "no time left for retry") {
+		t.Error("want retries to be cut short by timeout")
+	}
+}
+
+func TestCoreLoopRetryNotOnPermanentFailure(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	arguments := "--retries=3 -- /var/run/nonexistant"
+	args, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	err = CoreLoopRetry(args, &bytes.Buffer{})
+	t.Log(output.String())
+	if _, ok := err.(*NotAvailableError); !ok {
+		t.Error("want not available error, got", err)
+	}
+	if !strings.Contains(output.String(), "not retrying after notavailable failure") {
+		t.Error("want no retry for unavailable command")
+	}
+}
+
+func TestCoreLoopRetryOnExitCode(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	statefile, err := ioutil.TempFile("./testdata", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		os.Remove(statefile.Name())
+		statefile.Close()
+	}()
+
+	for _, tc := range []struct {
+		filter string
+		ok     bool
+	}{
+		{"--retry-on-exit=75", false},
+		{"--retry-on-exit=75,1", true},
+	} {
+		opts = oldopts
+		if err := statefile.Truncate(0); err != nil {
+			t.Fatal(err)
+		}
+
+		arguments := "--retries=3 " + tc.filter + " -- ./testdata/works-after-two-failures.sh " + statefile.Name()
+		args, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var output bytes.Buffer
+		log.SetOutput(&output)
+
+		err = CoreLoopRetry(args, &bytes.Buffer{})
+		t.Log(output.String())
+		if tc.ok && err != nil {
+			t.Errorf("%s: want no error, got %v", tc.filter, err)
+		} else if !tc.ok && exitCode(err) != 1 {
+			t.Errorf("%s: want exit code 1 without retry, got %v", tc.filter, err)
+		}
+	}
+}
+
+func TestCoreLoopOncePassesSlot(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	args, err := flags.ParseArgs(&opts, []string{"--max-concurrent=3", "--", "sh", "-c", `test "$PN_SLOT" = 1`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	err = CoreLoopOnce(args, &bytes.Buffer{})
+	t.Log(output.String())
+	if err != nil {
+		t.Error("want PN_SLOT=1 in environment, got", err)
+	}
+}
+
+func TestCoreLoopRetryLateRetry(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	arguments := "--retries=1 --retry-delay=600ms --timeout=1s --grace-time=500ms -- sh -c"
+	args, err := flags.ParseArgs(&opts, append(strings.Fields(arguments), "sleep 0.2; exit 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	err = CoreLoopRetry(args, &bytes.Buffer{})
+	t.Log(output.String())
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Error("want exit error of first attempt, got", err)
+	}
+	if !strings.Contains(output.String(), "no time left for retry") {
+		t.Error("want no retry with less than grace time left")
+	}
+}
+
+func TestCoreLoopUntilLessThanGraceTimeLeft(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	arguments := "--timeout=1s --grace-time=500ms -- sleep 0.1"
+	args, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	// e.g. a retry late within the budget
+	err = CoreLoopUntil(args, &bytes.Buffer{}, time.Now().Add(300*time.Millisecond))
+	t.Log(output.String())
+	if err != nil {
+		t.Error("want no soft timeout right away, got", err)
+	}
+}
+
+func TestCoreLoopOnceSignalIsGraceful(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	dir, err := ioutil.TempDir("", "TestCoreLoopOnceSignalIsGraceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := dir + "/terminated"
+
+	arguments := "--timeout=10s --grace-time=5s -- sh -c"
+	args, err := flags.ParseArgs(&opts, append(strings.Fields(arguments), `trap "echo graceful > `+marker+`; exit 0" TERM; sleep 10 & wait`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	start := time.Now()
+	err = CoreLoopOnce(args, &bytes.Buffer{})
+	t.Log(output.String())
+	if err != nil {
+		t.Error("want command to exit on its own, got", err)
+	}
+	if got := readFile(t, marker); got != "graceful\n" {
+		t.Errorf("got %q, want command to catch SIGTERM", got)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("took %s, want no wait for grace time", took)
+	}
+}
+
+func TestCoreLoopRetryNotAfterSignal(t *testing.T) {
+	oldopts, oldRun := opts, currentRun
+	defer func() { opts, currentRun = oldopts, oldRun }()
+
+	arguments := "--timeout=10s --grace-time=1s --retries=2 --retry-delay=0s -- sleep 3"
+	args, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	start := time.Now()
+	err = CoreLoopRetry(args, &bytes.Buffer{})
+	t.Log(output.String())
+	if _, ok := err.(*SignalledError); !ok {
+		t.Errorf("got %v, want signalled error", err)
+	}
+	if currentRun.Attempts != 1 {
+		t.Errorf("got %d attempts, want no retry after signal", currentRun.Attempts)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("took %s, want command stopped right away", took)
+	}
+}
+
+func TestCoreLoopOnceSignalEscalates(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	arguments := "--timeout=10s --grace-time=300ms -- sh -c"
+	args, err := flags.ParseArgs(&opts, append(strings.Fields(arguments), `trap "" TERM; sleep 10; sleep 10`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	start := time.Now()
+	CoreLoopOnce(args, &bytes.Buffer{})
+	t.Log(output.String())
+	if took := time.Since(start); took < 500*time.Millisecond || took > 3*time.Second {
+		t.Errorf("took %s, want SIGKILL after grace time of 300ms", took)
+	}
+	if !strings.Contains(output.String(), "Grace time after signal is over") {
+		t.Error("want escalation after grace time")
+	}
+}
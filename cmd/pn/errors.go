@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/exec"
+	"syscall"
 	"time"
 )
 
@@ -39,6 +41,20 @@ func (e *TimeoutError) Error() string {
 	return fmt.Sprintf("Hard timeout after %s, killed with %s", e.after, os.Kill)
 }
 
+// SignalledError happens, when pn has been signalled to stop while running the command.
+// It is never retried, since whoever sent the signal wants the command to stop.
+type SignalledError struct {
+	signal os.Signal
+	err    error // of the interrupted command, if any
+}
+
+func (e *SignalledError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("Interrupted by signal %s", e.signal)
+	}
+	return fmt.Sprintf("Interrupted by signal %s: %s", e.signal, e.err)
+}
+
 // LockError happens, when the file base lock cannot be aquired
 type LockError struct {
 	name string
@@ -48,3 +64,59 @@ type LockError struct {
 func (e *LockError) Error() string {
 	return fmt.Sprintf("cannot get lockfile %s: %s", e.name, e.err)
 }
+
+// Classes of errors, as selected by --retry-on
+const (
+	errorClassTimeout      = "timeout"
+	errorClassExit         = "exit"
+	errorClassLock         = "lock"
+	errorClassNotAvailable = "notavailable"
+	errorClassStartup      = "startup"
+	errorClassSignal       = "signal"
+	errorClassUnknown      = "unknown"
+)
+
+// errorClasses lists all classes, which can be selected by the user
+var errorClasses = []string{
+	errorClassTimeout,
+	errorClassExit,
+	errorClassLock,
+	errorClassNotAvailable,
+	errorClassStartup,
+}
+
+// errorClass determines the class of err, e.g. "timeout" for a *TimeoutError
+func errorClass(err error) string {
+	switch err.(type) {
+	case *TimeoutError:
+		return errorClassTimeout
+	case *exec.ExitError:
+		return errorClassExit
+	case *LockError:
+		return errorClassLock
+	case *NotAvailableError:
+		return errorClassNotAvailable
+	case *StartupError:
+		return errorClassStartup
+	case *SignalledError:
+		return errorClassSignal
+	}
+	return errorClassUnknown
+}
+
+// exitCode extracts the exit code of the command from err.
+// Returns 0 for no error and -1, if the command didn't exit by itself.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	exiterr, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1
+	}
+	exitstate, ok := exiterr.Sys().(syscall.WaitStatus)
+	if !ok || !exitstate.Exited() {
+		return -1
+	}
+	return exitstate.ExitStatus()
+}
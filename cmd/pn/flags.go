@@ -2,21 +2,45 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Jimdo/periodicnoise/syslog"
 	flags "github.com/jessevdk/go-flags"
 )
 
 var opts struct {
 	Retries          uint          `long:"retries" default:"0" description:"how often to retry the execution, if it fails"`
+	RetryDelay       time.Duration `long:"retry-delay" default:"0s" description:"time to wait before the first retry, e.g. 5s, 1m"`
+	RetryBackoff     float64       `long:"retry-backoff-factor" default:"2" description:"multiply time to wait by this factor for each further retry"`
+	RetryMaxDelay    time.Duration `long:"retry-max-delay" description:"optional maximum time to wait between retries, e.g. 45s, 2m, 1h30m"`
+	RetryJitter      float64       `long:"retry-jitter" default:"0" description:"randomly shorten time to wait between retries by up to this fraction, e.g. 0.25"`
+	RetryOn          classList     `long:"retry-on" description:"retry only on these failures: timeout, exit, lock, notavailable, startup (default: timeout,exit)"`
+	RetryOnExit      exitCodeList  `long:"retry-on-exit" description:"retry only on these exit codes, e.g. 75,111"`
 	MaxDelay         time.Duration `short:"d" long:"max-start-delay" description:"optional maximum execution start delay for command, e.g. 45s, 2m, 1h30m"`
+	ScatterByHost    bool          `long:"scatter-by-host" description:"derive start delay from hostname and monitoring event instead of randomly, hosts may still share a delay"`
+	DryRun           bool          `long:"dry-run" description:"log the start delay, but do not execute command"`
 	Timeout          time.Duration `short:"t" long:"timeout" default:"1m" description:"set hard execution timeout for command, e.g. 45s, 2m, 1h30m"`
 	UseSyslog        bool          `short:"s" long:"use-syslog" description:"log via syslog instead of stderr"`
+	UseJournal       bool          `long:"use-journal" description:"log to the systemd journal instead of stderr"`
+	SyslogFormat     syslogFormat  `long:"syslog-format" default:"bsd" description:"format of syslog messages: bsd or rfc5424 (adds event, attempt and stream as structured data)"`
+	SyslogFacility   facility      `long:"syslog-facility" default:"daemon" description:"syslog facility, e.g. daemon, cron, local0"`
+	LogFile          string        `long:"log-file" description:"log to this file instead of stderr, %(event) is replaced by the monitoring event, e.g. /var/log/pn/%(event).log"`
+	LogFileSize      byteSize      `long:"log-file-size" default:"10M" description:"rotate the log file before it exceeds this size, e.g. 512K, 10M, 1G (0 disables rotation)"`
+	LogFileKeep      uint          `long:"log-file-keep" default:"5" description:"keep this many rotated log files"`
+	LogFormat        string        `long:"log-format" default:"text" description:"format of log lines on stderr or in the log file: text or json"`
 	WrapNagiosPlugin bool          `short:"n" long:"wrap-nagios-plugin" description:"wrap nagios plugin (pass on return codes, pass first 8KiB of stdout as message)"`
 	NoPipeStderr     bool          `long:"no-stream-stderr" description:"do not stream stderr to log"`
 	NoPipeStdout     bool          `long:"no-stream-stdout" description:"do not stream stdout to log"`
 	MonitoringEvent  string        `short:"E" long:"monitor-event" description:"monitoring event (defaults to check_foo for /path/check_foo.sh)"`
-	KillRunning      bool          `short:"k" long:"kill-running" description:"kill already running instance of command"`
+	LockDir          string        `long:"lock-dir" description:"keep lock files below this directory, e.g. /run/periodicnoise (defaults to directory for temporary files)"`
+	LockName         string        `long:"lock-name" description:"name of the lock, runs with the same name exclude each other (defaults to monitoring event)"`
+	MaxConcurrent    uint          `long:"max-concurrent" default:"1" description:"allow this many instances to run at the same time, the slot taken is passed as PN_SLOT"`
+	LockWait         time.Duration `long:"lock-wait" description:"wait this long for a running instance to finish instead of failing, e.g. 30s, 5m (counts against timeout)"`
+	LeaseDir         string        `long:"lease-dir" description:"take a lease on this shared directory instead of a local lock file, so only one host runs the command, e.g. /mnt/nfs/periodicnoise"`
+	LeaseTTL         time.Duration `long:"lease-ttl" description:"lease is valid this long without renewal, renewed thrice per TTL while running (default: 1m)"`
+	KillRunning      bool          `short:"k" long:"kill-running" description:"kill already running instance of command (SIGTERM, then SIGKILL after grace time)"`
 	NoMonitoring     bool          `long:"no-monitoring" description:"wrap command without sending monitoring events"`
 	GraceTime        time.Duration `long:"grace-time" default:"10s" description:"time left until TIMEOUT, before sending SIGTERM to command, e.g. 45s, 2m, 1h30m"`
 	MonitorOk        []uint8       `long:"monitor-ok" description:"add exit code to consider as no failure."`
@@ -25,6 +49,91 @@ var opts struct {
 	MonitorUnknown   []uint8       `long:"monitor-unknown" description:"add exit code to consider as state not known"`
 	SendAs           string        `long:"send-as" description:"send monitoring events masquerading as this entity"`
 	SendTo           string        `long:"send-to" description:"send monitoring events to this service"`
+	StateDir         string        `long:"state-dir" description:"keep run history below this directory, e.g. /var/lib/periodicnoise (defaults to directory for temporary files)"`
+	NoHistory        bool          `long:"no-history" description:"do not record this run in the run history"`
+	AlertAfter       uint          `long:"alert-after" default:"1" description:"report failures to monitoring only after this many consecutive failures"`
+	WarnBeforeAlert  bool          `long:"warn-before-alert" description:"report failures as WARNING until --alert-after is reached instead of not at all"`
+}
+
+// exitCodeList collects exit codes from comma separated lists, e.g. 75,111
+type exitCodeList []uint8
+
+// UnmarshalFlag implements flags.Unmarshaler
+func (l *exitCodeList) UnmarshalFlag(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		code, err := strconv.ParseUint(strings.TrimSpace(field), 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid exit code %q", field)
+		}
+		*l = append(*l, uint8(code))
+	}
+	return nil
+}
+
+// syslogFormat selects the format of syslog messages by name
+type syslogFormat struct {
+	syslog.Format
+}
+
+// UnmarshalFlag implements flags.Unmarshaler
+func (f *syslogFormat) UnmarshalFlag(value string) (err error) {
+	f.Format, err = syslog.ParseFormat(value)
+	return err
+}
+
+// byteSize is a size in bytes with an optional unit K, M or G, e.g. 10M
+type byteSize int64
+
+// UnmarshalFlag implements flags.Unmarshaler
+func (b *byteSize) UnmarshalFlag(value string) error {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+	number, unit := value, int64(1)
+	if n := len(value); n > 0 {
+		if u, ok := units[strings.ToUpper(value[n-1:])]; ok {
+			number, unit = value[:n-1], u
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid size %q, want e.g. 512K, 10M or 1G", value)
+	}
+	*b = byteSize(size * unit)
+	return nil
+}
+
+// facility selects the syslog facility by name
+type facility struct {
+	syslog.Priority
+}
+
+// UnmarshalFlag implements flags.Unmarshaler
+func (f *facility) UnmarshalFlag(value string) (err error) {
+	f.Priority, err = syslog.ParseFacility(value)
+	return err
+}
+
+// classList collects error classes from comma separated lists, e.g. timeout,lock
+type classList []string
+
+// UnmarshalFlag implements flags.Unmarshaler
+func (l *classList) UnmarshalFlag(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		class := strings.TrimSpace(field)
+		if !l.valid(class) {
+			return fmt.Errorf("invalid failure %q, want one of %s", class, strings.Join(errorClasses, ", "))
+		}
+		*l = append(*l, class)
+	}
+	return nil
+}
+
+func (l *classList) valid(class string) bool {
+	for _, c := range errorClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
 }
 
 // FlagConstraintError happens when command line arguments make no sense or contradict each other
@@ -41,6 +150,68 @@ func validateOptionConstraints() (err error) {
 		return &FlagConstraintError{Constraint: "max delay >= timeout, no time left for actual command execution"}
 	}
 
+	if opts.Retries > 0 && opts.RetryDelay >= opts.Timeout {
+		return &FlagConstraintError{Constraint: "retry delay >= timeout, no time left for retries"}
+	}
+
+	if opts.RetryBackoff < 1 {
+		return &FlagConstraintError{Constraint: "retry backoff factor < 1, waits between retries would shrink"}
+	}
+
+	if opts.RetryJitter < 0 || opts.RetryJitter > 1 {
+		return &FlagConstraintError{Constraint: "retry jitter must be between 0 and 1"}
+	}
+
+	destinations := 0
+	for _, used := range []bool{opts.UseSyslog, opts.UseJournal, opts.LogFile != ""} {
+		if used {
+			destinations++
+		}
+	}
+	if destinations > 1 {
+		return &FlagConstraintError{Constraint: "log either via syslog, to the journal or to a log file"}
+	}
+
+	if opts.LogFormat != "text" && opts.LogFormat != "json" {
+		return &FlagConstraintError{Constraint: fmt.Sprintf("unknown log format %q, want text or json", opts.LogFormat)}
+	}
+
+	if opts.LogFormat == "json" && (opts.UseSyslog || opts.UseJournal) {
+		return &FlagConstraintError{Constraint: "json log format needs logging to stderr or a log file"}
+	}
+
+	if opts.LockName != "" {
+		if err := validLockName(opts.LockName); err != nil {
+			return &FlagConstraintError{Constraint: err.Error()}
+		}
+	}
+
+	if opts.MaxConcurrent == 0 {
+		return &FlagConstraintError{Constraint: "max concurrent must be at least 1"}
+	}
+
+	if opts.MaxConcurrent > 1 && opts.KillRunning {
+		return &FlagConstraintError{Constraint: "kill running needs a single instance, not max concurrent > 1"}
+	}
+
+	if opts.LockWait > 0 && opts.KillRunning {
+		return &FlagConstraintError{Constraint: "either wait for lock or kill running instance"}
+	}
+
+	if opts.LockWait >= opts.Timeout {
+		return &FlagConstraintError{Constraint: "lock wait >= timeout, no time left for actual command execution"}
+	}
+
+	if opts.LeaseDir != "" {
+		if err := leaseConflict(opts.KillRunning); err != nil {
+			return &FlagConstraintError{Constraint: err.Error()}
+		}
+	}
+
+	if opts.AlertAfter > 1 && opts.NoHistory {
+		return &FlagConstraintError{Constraint: "alert after needs run history to count failures"}
+	}
+
 	// Setup constraint that exit code 0 is ALWAYS considered ok ...
 	unique := map[uint8]monitoringResult{
 		uint8(monitorOk): monitorOk,
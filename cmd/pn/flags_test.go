@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 
@@ -96,3 +97,118 @@ func TestDuplicateExitCodes(t *testing.T) {
 		t.Error("want flag constraint error, got", err)
 	}
 }
+
+func TestRetryDelayTooBig(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	arguments := "--timeout=1s --retries=1 --retry-delay=2s -- true"
+	_, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+	err = validateOptionConstraints()
+	if err == nil {
+		t.Error("want error, got nil")
+	} else if e, ok := err.(*FlagConstraintError); ok {
+		want := "retry delay >= timeout, no time left for retries"
+		if e.Constraint != want {
+			t.Errorf("want %s, got %s", want, err)
+		} else {
+			t.Log("got", err)
+		}
+	} else {
+		t.Error("want flag constraint error, got", err)
+	}
+}
+
+func TestRetryBackoffAndJitterRange(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	for _, arguments := range []string{
+		"--retry-backoff-factor=0.5 -- true",
+		"--retry-jitter=-0.1 -- true",
+		"--retry-jitter=1.5 -- true",
+	} {
+		opts = oldopts
+		_, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = validateOptionConstraints()
+		if _, ok := err.(*FlagConstraintError); !ok {
+			t.Errorf("%s: want flag constraint error, got %v", arguments, err)
+		} else {
+			t.Log("got", err)
+		}
+	}
+}
+
+func TestRetryFilterLists(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	arguments := "--retry-on=timeout,lock --retry-on=startup --retry-on-exit=75,111 --retry-on-exit=1 -- true"
+	_, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (classList{"timeout", "lock", "startup"}); !reflect.DeepEqual(opts.RetryOn, want) {
+		t.Errorf("got %v, want %v", opts.RetryOn, want)
+	}
+	if want := (exitCodeList{75, 111, 1}); !reflect.DeepEqual(opts.RetryOnExit, want) {
+		t.Errorf("got %v, want %v", opts.RetryOnExit, want)
+	}
+}
+
+func TestRetryFilterListsInvalid(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	for _, arguments := range []string{
+		"--retry-on=timeout,sunspots -- true",
+		"--retry-on-exit=75,256 -- true",
+		"--retry-on-exit=x -- true",
+	} {
+		opts = oldopts
+		if _, err := flags.ParseArgs(&opts, strings.Fields(arguments)); err == nil {
+			t.Errorf("%s: want error, got nil", arguments)
+		} else {
+			t.Log("got", err)
+		}
+	}
+}
+
+func TestInvalidLockName(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	for _, name := range []string{"../etc", "db/backup", ".."} {
+		opts = oldopts
+		if _, err := flags.ParseArgs(&opts, []string{"--lock-name=" + name, "--", "true"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := validateOptionConstraints(); err == nil {
+			t.Errorf("%s: want error, got nil", name)
+		}
+	}
+}
+
+func TestLockConstraints(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	for _, arguments := range []string{
+		"--max-concurrent=0 -- true",
+		"--max-concurrent=2 --kill-running -- true",
+		"--lock-wait=1m --kill-running -- true",
+		"--lock-wait=1m --timeout=1m -- true",
+	} {
+		opts = oldopts
+		if _, err := flags.ParseArgs(&opts, strings.Fields(arguments)); err != nil {
+			t.Fatal(err)
+		}
+		if err := validateOptionConstraints(); err == nil {
+			t.Errorf("%s: want error, got nil", arguments)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+)
+
+// historySize limits the number of runs kept per monitoring event.
+const historySize = 100
+
+// historyOutputSize limits the output kept per run.
+const historyOutputSize = 512
+
+// RunRecord describes one invocation of the wrapped command.
+type RunRecord struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Attempts uint          `json:"attempts"`
+	ExitCode int           `json:"exit_code"`
+	Result   string        `json:"result"`
+	Failure  string        `json:"failure,omitempty"`
+	Output   string        `json:"output,omitempty"`
+}
+
+// currentRun collects facts about this invocation for the run history.
+var currentRun RunRecord
+
+// outputHead captures the first bytes of stdout for the run history.
+var outputHead *CapWriter
+
+// historyDir returns the directory keeping the run history of the monitoring event.
+func historyDir() string {
+	dir := opts.StateDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "periodicnoise-"+monitoringEvent)
+}
+
+// historyFile returns the file keeping the run history of the monitoring event.
+func historyFile() string {
+	return filepath.Join(historyDir(), monitoringEvent+".history")
+}
+
+// loadHistory reads the runs recorded in filename, oldest first.
+// A missing file just means there is no history yet.
+// Corrupt records, e.g. from a full disk, are logged and skipped.
+func loadHistory(filename string) ([]RunRecord, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []RunRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec RunRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("ERROR: skipping corrupt record in %s: %s\n", filename, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// historyLockWait limits how long to wait for concurrent invocations
+// recording their runs, e.g. with --max-concurrent or --lock-name.
+var historyLockWait = 5 * time.Second
+
+// lockHistory takes the lock file next to the history filename, so concurrent
+// invocations don't overwrite each other's records.
+func lockHistory(filename string) (lockfile.Lockfile, error) {
+	abs, err := filepath.Abs(filename + ".lock")
+	if err != nil {
+		return "", err
+	}
+	lock, err := lockfile.New(abs)
+	if err != nil {
+		return lock, err
+	}
+	giveUp := time.Now().Add(historyLockWait)
+	for {
+		err := lock.TryLock()
+		// busy or just taken over by someone else
+		if _, ok := err.(lockfile.TemporaryError); !ok || time.Now().After(giveUp) {
+			return lock, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// appendHistory adds rec to the runs recorded in filename, keeping only
+// the latest historySize runs. The file is replaced atomically, so readers
+// never see partial records.
+func appendHistory(filename string, rec RunRecord) error {
+	lock, err := lockHistory(filename)
+	if err != nil {
+		return fmt.Errorf("locking history: %s", err)
+	}
+	defer lock.Unlock()
+
+	records, err := loadHistory(filename)
+	if err != nil {
+		return err
+	}
+	records = append(records, rec)
+	if len(records) > historySize {
+		records = records[len(records)-historySize:]
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// recordRun stores currentRun in the run history of the monitoring event.
+func recordRun() error {
+	if opts.NoHistory {
+		return nil
+	}
+	if err := privateSubdir(historyDir()); err != nil {
+		return err
+	}
+	if outputHead != nil {
+		currentRun.Output = string(outputHead.Bytes())
+	}
+	return appendHistory(historyFile(), currentRun)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryMissing(t *testing.T) {
+	records, err := loadHistory("testdata/nonexistant.history")
+	if err != nil {
+		t.Error("want no error, got", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("want no records, got %v", records)
+	}
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pnhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test.history")
+	start := time.Date(2015, 8, 24, 12, 24, 33, 0, time.UTC)
+	want := []RunRecord{
+		{Start: start, Duration: time.Second, Attempts: 1, ExitCode: 0, Result: "OK", Output: "done\n"},
+		{Start: start.Add(time.Hour), Duration: time.Minute, Attempts: 3, ExitCode: 1, Result: "CRITICAL"},
+	}
+	for _, rec := range want {
+		if err := appendHistory(filename, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := loadHistory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].Start.Equal(want[i].Start) {
+			t.Errorf("%d: got start %s, want %s", i, got[i].Start, want[i].Start)
+		}
+		got[i].Start = want[i].Start
+		if got[i] != want[i] {
+			t.Errorf("%d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHistoryIsTrimmed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pnhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test.history")
+	for i := 0; i < historySize+10; i++ {
+		if err := appendHistory(filename, RunRecord{Attempts: uint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := loadHistory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != historySize {
+		t.Fatalf("got %d records, want %d", len(records), historySize)
+	}
+	if first := records[0].Attempts; first != 10 {
+		t.Errorf("want oldest records dropped, got first record of run %d", first)
+	}
+}
+
+func TestHistoryCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pnhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	// e.g. truncated by a full disk
+	filename := filepath.Join(dir, "test.history")
+	content := "{\"attempts\":1,\"result\":\"OK\"}\n{\"attempts\":2,\"res\n{\"attempts\":3,\"result\":\"OK\"}\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendHistory(filename, RunRecord{Attempts: 4, Result: "CRITICAL"}); err != nil {
+		t.Fatal("want corrupt record skipped, got", err)
+	}
+
+	records, err := loadHistory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attempts []uint
+	for _, rec := range records {
+		attempts = append(attempts, rec.Attempts)
+	}
+	if fmt.Sprint(attempts) != "[1 3 4]" {
+		t.Errorf("got records of runs %v, want [1 3 4]", attempts)
+	}
+	if !strings.Contains(output.String(), "corrupt record") {
+		t.Errorf("want corrupt record logged, got %q", output.String())
+	}
+}
+
+func TestRecordRun(t *testing.T) {
+	oldopts := opts
+	oldEvent := monitoringEvent
+	oldRun := currentRun
+	defer func() {
+		opts = oldopts
+		monitoringEvent = oldEvent
+		currentRun = oldRun
+	}()
+
+	dir, err := ioutil.TempDir("", "pnhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts.StateDir = dir
+	monitoringEvent = "TestRecordRun"
+	currentRun = RunRecord{Start: time.Now(), Attempts: 1, Result: "OK"}
+
+	if err := recordRun(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := loadHistory(filepath.Join(dir, "periodicnoise-TestRecordRun", "TestRecordRun.history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Result != "OK" {
+		t.Errorf("want one OK record, got %+v", records)
+	}
+}
+
+// TestHelperAppendHistory is not a real test, but an invocation of pn
+// recording runs for TestHistoryConcurrentInvocations.
+func TestHelperAppendHistory(t *testing.T) {
+	filename := os.Getenv("PN_TEST_HISTORY")
+	if filename == "" {
+		return
+	}
+	for i := 0; i < 20; i++ {
+		if err := appendHistory(filename, RunRecord{Attempts: uint(i), Result: "OK"}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
+
+func TestHistoryConcurrentInvocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pnhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.history")
+
+	var invocations []*exec.Cmd
+	for i := 0; i < 4; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=TestHelperAppendHistory")
+		cmd.Env = append(os.Environ(), "PN_TEST_HISTORY="+filename)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		invocations = append(invocations, cmd)
+	}
+	for _, cmd := range invocations {
+		if err := cmd.Wait(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	records, err := loadHistory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 80 {
+		t.Errorf("got %d records, want 80 of 4 invocations", len(records))
+	}
+}
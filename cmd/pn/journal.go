@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Jimdo/periodicnoise/journal"
+)
+
+// this enables testing
+var journalPath string
+
+// journalLogger sends messages to the systemd journal, tagged with
+// monitoring event, attempt and stream, so they can be queried like
+// journalctl PN_EVENT=backup_db
+type journalLogger struct {
+	c      *journal.Conn
+	stream string
+}
+
+// forStream returns a logger for messages of stream, e.g. "stdout".
+func (j *journalLogger) forStream(stream string) *journalLogger {
+	return &journalLogger{c: j.c, stream: stream}
+}
+
+func (j *journalLogger) Write(p []byte) (int, error) {
+	// LineWriter passes on what follows the last line break, even if empty
+	if len(p) == 0 {
+		return 0, nil
+	}
+	severity, ok := logSeverities[j.stream]
+	if !ok {
+		severity = messageSeverity(p)
+	}
+	err := j.c.Send(strings.TrimSuffix(string(p), "\n"), journal.Priority(severity), map[string]string{
+		"SYSLOG_IDENTIFIER": monitoringEvent,
+		"PN_EVENT":          monitoringEvent,
+		"PN_ATTEMPT":        strconv.FormatUint(uint64(currentRun.Attempts), 10),
+		"PN_STREAM":         j.stream,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
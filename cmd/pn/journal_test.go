@@ -0,0 +1,82 @@
+// +build linux
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournalLogger(t *testing.T) {
+	oldopts, oldPath, oldEvent, oldRun := opts, journalPath, monitoringEvent, currentRun
+	defer func() {
+		opts, journalPath, monitoringEvent, currentRun = oldopts, oldPath, oldEvent, oldRun
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+	log.SetFlags(0)
+
+	dir, err := ioutil.TempDir("", "TestJournalLogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journalPath = filepath.Join(dir, "socket")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: journalPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	opts.UseJournal = true
+	monitoringEvent = "backup_db"
+	currentRun.Attempts = 2
+	logger, err := getLogger(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func() map[string]string {
+		buf := make([]byte, 4096)
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := l.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := map[string]string{}
+		for _, line := range strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n") {
+			kv := strings.SplitN(line, "=", 2)
+			fields[kv[0]] = kv[1]
+		}
+		return fields
+	}
+
+	io.WriteString(streamLogger(logger, "stderr"), "disk full\n")
+	got := receive()
+	want := map[string]string{
+		"MESSAGE":           "disk full",
+		"PRIORITY":          "3",
+		"SYSLOG_IDENTIFIER": "backup_db",
+		"PN_EVENT":          "backup_db",
+		"PN_ATTEMPT":        "2",
+		"PN_STREAM":         "stderr",
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s: got %q, want %q", name, got[name], value)
+		}
+	}
+
+	log.Println("FATAL: something went wrong")
+	got = receive()
+	if got["PRIORITY"] != "2" || got["PN_STREAM"] != "pn" || got["MESSAGE"] != "FATAL: something went wrong" {
+		t.Errorf("got %q, want our own message at severity crit", got)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// jsonMessage is a line of output or our own message in --log-format=json
+type jsonMessage struct {
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"`
+	Stream    string    `json:"stream"`
+	Attempt   uint      `json:"attempt"`
+	Pid       int       `json:"pid"`
+	Host      string    `json:"host"`
+	Message   string    `json:"message"`
+}
+
+// jsonLogger writes each message as JSON object on a line of its own.
+type jsonLogger struct {
+	w      io.Writer
+	host   string
+	stream string
+}
+
+func newJSONLogger(w io.Writer) *jsonLogger {
+	host, _ := os.Hostname()
+	return &jsonLogger{w: w, host: host, stream: "pn"}
+}
+
+// forStream returns a logger for messages of stream, e.g. "stdout".
+func (j *jsonLogger) forStream(stream string) *jsonLogger {
+	return &jsonLogger{w: j.w, host: j.host, stream: stream}
+}
+
+func (j *jsonLogger) Write(p []byte) (int, error) {
+	// LineWriter passes on what follows the last line break, even if empty
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b, err := json.Marshal(jsonMessage{
+		Timestamp: time.Now(),
+		Event:     monitoringEvent,
+		Stream:    j.stream,
+		Attempt:   currentRun.Attempts,
+		Pid:       os.Getpid(),
+		Host:      j.host,
+		Message:   strings.TrimSuffix(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	// a single write keeps concurrent messages apart
+	if _, err := j.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
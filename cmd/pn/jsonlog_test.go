@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	flags "github.com/jessevdk/go-flags"
+)
+
+func TestJSONLogger(t *testing.T) {
+	oldEvent, oldRun := monitoringEvent, currentRun
+	defer func() { monitoringEvent, currentRun = oldEvent, oldRun }()
+	monitoringEvent = "backup_db"
+	currentRun.Attempts = 2
+
+	var buf bytes.Buffer
+	logger := &LineWriter{w: newJSONLogger(&buf)}
+	stderr := streamLogger(logger, "stderr")
+	if _, err := io.WriteString(stderr, "first \"line\"\nsecond line\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []jsonMessage
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var m jsonMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("%q: %v", scanner.Text(), err)
+		}
+		got = append(got, m)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d messages, want one per line", len(got))
+	}
+
+	host, _ := os.Hostname()
+	for i, want := range []string{`first "line"`, "second line"} {
+		m := got[i]
+		if m.Message != want {
+			t.Errorf("got message %q, want %q", m.Message, want)
+		}
+		if m.Event != "backup_db" || m.Stream != "stderr" || m.Attempt != 2 ||
+			m.Pid != os.Getpid() || m.Host != host || m.Timestamp.IsZero() {
+			t.Errorf("got %+v", m)
+		}
+	}
+}
+
+func TestJSONLoggerOwnMessages(t *testing.T) {
+	var buf bytes.Buffer
+	j := newJSONLogger(&buf)
+	if _, err := io.WriteString(j, "FATAL: something\nwent wrong\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	var m jsonMessage
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Stream != "pn" || m.Message != "FATAL: something\nwent wrong" {
+		t.Errorf("got %+v", m)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Errorf("got %d lines, want one JSON object per message", n)
+	}
+}
+
+func TestLogFormatConstraints(t *testing.T) {
+	for _, arguments := range []string{
+		"--log-format=xml -- true",
+		"--log-format=json --use-syslog -- true",
+	} {
+		oldopts := opts
+		_, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+		if err == nil {
+			err = validateOptionConstraints()
+		}
+		opts = oldopts
+		if err == nil {
+			t.Errorf("%s: want error, got nil", arguments)
+		} else {
+			t.Log("got", err)
+		}
+	}
+}
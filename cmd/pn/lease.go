@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+)
+
+// ErrLeaseLost means another holder took over our lease, e.g. because we
+// could not renew it in time.
+var ErrLeaseLost = errors.New("lease taken over by another holder")
+
+// leaseRecord is the content of a lease file, naming its holder.
+type leaseRecord struct {
+	Host    string    `json:"host"`
+	Pid     int       `json:"pid"`
+	Expires time.Time `json:"expires"`
+}
+
+// sameHolder reports whether rec and other name the same process.
+func (rec leaseRecord) sameHolder(other leaseRecord) bool {
+	return rec.Host == other.Host && rec.Pid == other.Pid
+}
+
+// expired reports whether the holder of rec didn't renew it in time or is
+// a process of host, which is gone.
+func (rec leaseRecord) expired(host string) bool {
+	if time.Now().After(rec.Expires) {
+		return true
+	}
+	return rec.Host == host && syscall.Kill(rec.Pid, 0) == syscall.ESRCH
+}
+
+// readLease reads the lease record in filename.
+func readLease(filename string) (rec leaseRecord, err error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(b, &rec)
+	return rec, err
+}
+
+// onLeaseLost is called, when the heartbeat finds our lease taken over.
+// Terminating ourselves makes CoreLoopUntil kill the command,
+// since another host might run it already.
+var onLeaseLost = func() {
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		TerminateProcess(p)
+	}
+}
+
+// leaseGenerations lists the generations of lease name, oldest first.
+func leaseGenerations(name string) ([]int, error) {
+	matches, err := filepath.Glob(name + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var generations []int
+	for _, m := range matches {
+		// skips temporary files
+		if g, err := strconv.Atoi(strings.TrimPrefix(m, name+".")); err == nil && g > 0 {
+			generations = append(generations, g)
+		}
+	}
+	sort.Ints(generations)
+	return generations, nil
+}
+
+// Lease is a lock shared by several hosts via a file on a shared directory,
+// e.g. on NFS. It is valid for ttl and renewed by a heartbeat until Unlock.
+// Hostname and PID of the holder fence it against other holders.
+// Expiry is judged by the clocks of the hosts, so keep them in sync.
+//
+// The lease is kept in generations NAME.1, NAME.2, ... of which the latest
+// is valid. Taking over creates the next generation via link(2), so only one
+// of several hosts taking over at the same time wins.
+type Lease struct {
+	name       string
+	ttl        time.Duration
+	self       leaseRecord
+	generation int
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// file returns the file of generation g of the lease.
+func (l *Lease) file(g int) string {
+	return fmt.Sprintf("%s.%d", l.name, g)
+}
+
+// createLease takes the lease filename, if it is free or expired, and starts
+// renewing it. Returns lockfile.ErrBusy, if it is held by someone else.
+func createLease(filename string, ttl time.Duration) (*Lease, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	l := &Lease{
+		name: filename,
+		ttl:  ttl,
+		self: leaseRecord{Host: host, Pid: os.Getpid()},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := l.acquire(); err != nil {
+		return nil, err
+	}
+	go l.heartbeat()
+	return l, nil
+}
+
+// writeTemp writes our record, valid for another ttl, to a temporary file
+// next to the lease and returns its name.
+func (l *Lease) writeTemp() (string, error) {
+	l.self.Expires = time.Now().Add(l.ttl)
+	b, err := json.Marshal(l.self)
+	if err != nil {
+		return "", err
+	}
+	tmp := fmt.Sprintf("%s.tmp.%s.%d", l.name, l.self.Host, l.self.Pid)
+	return tmp, ioutil.WriteFile(tmp, append(b, '\n'), 0644)
+}
+
+func (l *Lease) acquire() error {
+	tmp, err := l.writeTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	generations, err := leaseGenerations(l.name)
+	if err != nil {
+		return err
+	}
+	latest := 0
+	var current leaseRecord
+	junk := os.ErrNotExist
+	if len(generations) > 0 {
+		latest = generations[len(generations)-1]
+		// unreadable leases are junk, since they are never written in place
+		current, junk = readLease(l.file(latest))
+		if junk == nil && !current.expired(l.self.Host) {
+			return lockfile.ErrBusy
+		}
+	}
+
+	// linking fails, if the file exists, and is atomic even on NFS,
+	// so only one of several hosts taking over wins
+	if err := os.Link(tmp, l.file(latest+1)); os.IsExist(err) {
+		return lockfile.ErrBusy
+	} else if err != nil {
+		return err
+	}
+	l.generation = latest + 1
+
+	for _, g := range generations {
+		os.Remove(l.file(g))
+	}
+	if junk == nil {
+		log.Printf("INFO: took over expired lease %s of %s (PID %d)\n", l.name, current.Host, current.Pid)
+	}
+	return nil
+}
+
+// verify checks, that we still hold the lease.
+func (l *Lease) verify() error {
+	generations, err := leaseGenerations(l.name)
+	if err != nil {
+		return err
+	}
+	if len(generations) == 0 || generations[len(generations)-1] != l.generation {
+		return ErrLeaseLost
+	}
+	current, err := readLease(l.file(l.generation))
+	if os.IsNotExist(err) {
+		return ErrLeaseLost
+	} else if err != nil {
+		return err
+	}
+	if !current.sameHolder(l.self) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// renew extends the lease by another ttl, if we still hold it.
+func (l *Lease) renew() error {
+	if err := l.verify(); err != nil {
+		return err
+	}
+	tmp, err := l.writeTemp()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.file(l.generation)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// heartbeat renews the lease three times per ttl until Unlock.
+func (l *Lease) heartbeat() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			err := l.renew()
+			if err == ErrLeaseLost {
+				log.Println("ERROR: lost lease", l.name+", terminating")
+				onLeaseLost()
+				return
+			} else if err != nil {
+				// retry on next tick, the lease is still valid for a while
+				log.Println("ERROR: cannot renew lease", l.name+":", err)
+			}
+		}
+	}
+}
+
+// Unlock stops renewing the lease and releases it, if we still hold it.
+func (l *Lease) Unlock() error {
+	close(l.stop)
+	<-l.done
+
+	if err := l.verify(); err != nil {
+		return err
+	}
+	return os.Remove(l.file(l.generation))
+}
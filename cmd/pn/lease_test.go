@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+)
+
+// writeLease pretends rec holds the lease filename.
+func writeLease(t *testing.T, filename string, rec leaseRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func leaseDirForTest(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "TestLease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "backup_db.lease"), func() { os.RemoveAll(dir) }
+}
+
+func TestLease(t *testing.T) {
+	filename, cleanup := leaseDirForTest(t)
+	defer cleanup()
+
+	l, err := createLease(filename, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _ := os.Hostname()
+	rec, err := readLease(filename + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Host != host || rec.Pid != os.Getpid() || rec.Expires.Before(time.Now().Add(50*time.Second)) {
+		t.Errorf("got %+v, want us holding it for a minute", rec)
+	}
+
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(filename + "*"); len(matches) > 0 {
+		t.Errorf("want lease and temporary files removed after unlock, got %v", matches)
+	}
+}
+
+func TestLeaseBusy(t *testing.T) {
+	filename, cleanup := leaseDirForTest(t)
+	defer cleanup()
+
+	other := leaseRecord{Host: "otherhost", Pid: 4711, Expires: time.Now().Add(time.Minute)}
+	writeLease(t, filename+".1", other)
+	if _, err := createLease(filename, time.Minute); err != lockfile.ErrBusy {
+		t.Errorf("got %v, want %v", err, lockfile.ErrBusy)
+	}
+	if rec, _ := readLease(filename + ".1"); !rec.sameHolder(other) {
+		t.Errorf("got %+v, want lease of other host kept", rec)
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+	filename, cleanup := leaseDirForTest(t)
+	defer cleanup()
+
+	// a dead process of this host
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Fatal(err)
+	}
+	host, _ := os.Hostname()
+
+	for _, stale := range []leaseRecord{
+		{Host: "otherhost", Pid: 4711, Expires: time.Now().Add(-time.Second)},
+		{Host: host, Pid: dead.Process.Pid, Expires: time.Now().Add(time.Minute)},
+	} {
+		writeLease(t, filename+".1", stale)
+		l, err := createLease(filename, time.Minute)
+		if err != nil {
+			t.Errorf("%+v: want to take over, got %v", stale, err)
+			continue
+		}
+		if l.generation != 2 {
+			t.Errorf("got generation %d, want 2", l.generation)
+		}
+		if _, err := os.Stat(filename + ".1"); !os.IsNotExist(err) {
+			t.Errorf("want expired generation removed, got %v", err)
+		}
+		if err := l.Unlock(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestLeaseTakeoverRace(t *testing.T) {
+	filename, cleanup := leaseDirForTest(t)
+	defer cleanup()
+
+	for round := 0; round < 20; round++ {
+		leftovers, _ := filepath.Glob(filename + ".*")
+		for _, f := range leftovers {
+			os.Remove(f)
+		}
+		writeLease(t, filename+".1", leaseRecord{Host: "otherhost", Pid: 4711, Expires: time.Now().Add(-time.Second)})
+
+		var wg sync.WaitGroup
+		won := make(chan string, 4)
+		for i := 0; i < 4; i++ {
+			l := &Lease{name: filename, ttl: time.Minute, self: leaseRecord{Host: fmt.Sprint("taker", i), Pid: 4711}}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := l.acquire(); err == nil {
+					won <- l.self.Host
+				} else if err != lockfile.ErrBusy {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		close(won)
+
+		var winners []string
+		for w := range won {
+			winners = append(winners, w)
+		}
+		if len(winners) != 1 {
+			t.Fatalf("round %d: got winners %v, want exactly one", round, winners)
+		}
+	}
+}
+
+func TestLeaseHeartbeat(t *testing.T) {
+	filename, cleanup := leaseDirForTest(t)
+	defer cleanup()
+
+	l, err := createLease(filename, 90*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+	rec, err := readLease(filename + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Expires.After(time.Now()) {
+		t.Errorf("lease expired at %s, want it renewed", rec.Expires)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	oldLost := onLeaseLost
+	defer func() { onLeaseLost = oldLost }()
+	lost := make(chan bool, 1)
+	onLeaseLost = func() { lost <- true }
+
+	filename, cleanup := leaseDirForTest(t)
+	defer cleanup()
+
+	l, err := createLease(filename, 60*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another host took over, e.g. because we have been stuck too long
+	writeLease(t, filename+".2", leaseRecord{Host: "otherhost", Pid: 4711, Expires: time.Now().Add(time.Minute)})
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("want lost lease noticed")
+	}
+
+	if err := l.Unlock(); err != ErrLeaseLost {
+		t.Errorf("got %v, want %v", err, ErrLeaseLost)
+	}
+	if rec, _ := readLease(filename + ".2"); rec.Host != "otherhost" {
+		t.Errorf("got %+v, want lease of other host kept", rec)
+	}
+}
+
+func TestTakeLockLease(t *testing.T) {
+	oldopts, oldConfig, oldEvent := opts, lockConfig, monitoringEvent
+	defer func() { opts, lockConfig, monitoringEvent = oldopts, oldConfig, oldEvent }()
+
+	filename, cleanup := leaseDirForTest(t)
+	defer cleanup()
+	opts.LeaseDir, opts.MaxConcurrent = filepath.Dir(filename), 1
+	monitoringEvent = "backup_db"
+
+	if got := lockPath(); got != filename {
+		t.Errorf("got %s, want %s", got, filename)
+	}
+	lock, _, err := takeLock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lock.(*Lease); !ok {
+		t.Errorf("got %T, want lease", lock)
+	}
+	lock.Unlock()
+
+	if _, _, err := takeLock(true); err == nil {
+		t.Error("want error for kill running with lease")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+// lineRecorder records each write
+type lineRecorder struct {
+	lines []string
+}
+
+func (l *lineRecorder) Write(p []byte) (int, error) {
+	l.lines = append(l.lines, string(p))
+	return len(p), nil
+}
+
+func TestLineWriter(t *testing.T) {
+	var rec lineRecorder
+	w := &LineWriter{w: &rec}
+	in := "first\nsecond\nthird"
+	n, err := io.WriteString(w, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(in) {
+		t.Errorf("got %d bytes written, want %d", n, len(in))
+	}
+	if want := []string{"first\n", "second\n", "third"}; !reflect.DeepEqual(rec.lines, want) {
+		t.Errorf("got %q, want %q", rec.lines, want)
+	}
+}
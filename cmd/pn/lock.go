@@ -2,9 +2,16 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/nightlyone/lockfile"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // ErrNeedDirectory means the directory for the lock file actualy not a directory.
@@ -35,12 +42,220 @@ func privateSubdir(dirname string) error {
 	return nil
 }
 
-// Create a new lock file. Ensures that only one of these command runs
-// concurrently on this machine.  Also cleans up stale locks of dead instances.
-func createLock(killRunning bool) (lockfile.Lockfile, error) {
+// lockConfig holds lock directory, name and lease settings from the config files.
+// --lock-dir, --lock-name, --lease-dir and --lease-ttl override them.
+var lockConfig struct {
+	Dir      string
+	Name     string
+	LeaseDir string
+	LeaseTTL time.Duration
+}
+
+// defaultLeaseTTL is how long a lease is valid without renewal by default.
+const defaultLeaseTTL = time.Minute
+
+// Lock is a lock held until Unlock, either a local lock file or a lease.
+type Lock interface {
+	Unlock() error
+}
+
+// validLockName rejects lock names, which would escape the lock directory.
+func validLockName(name string) error {
+	if name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+		return fmt.Errorf("invalid lock name %q", name)
+	}
+	return nil
+}
+
+// lockName returns the name of the lock, which defaults to the monitoring event.
+func lockName() string {
+	name := opts.LockName
+	if name == "" {
+		name = lockConfig.Name
+	}
+	if name == "" {
+		name = monitoringEvent
+	}
+	return name
+}
+
+// lockFile returns the lock file for this run, which is NAME.lock in the private
+// directory periodicnoise-NAME of the lock directory. The lock directory defaults
+// to the directory for temporary files and is relative to the working directory.
+func lockFile() string {
+	dir := opts.LockDir
+	if dir == "" {
+		dir = lockConfig.Dir
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	// lock files need absolute paths
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	name := lockName()
+	return filepath.Join(dir, "periodicnoise-"+name, name+".lock")
+}
+
+// leaseDir returns the shared directory for leases, if leases are used instead of lock files.
+func leaseDir() string {
+	if opts.LeaseDir != "" {
+		return opts.LeaseDir
+	}
+	return lockConfig.LeaseDir
+}
+
+// leaseTTL returns how long a lease is valid without renewal.
+func leaseTTL() time.Duration {
+	if opts.LeaseTTL > 0 {
+		return opts.LeaseTTL
+	}
+	if lockConfig.LeaseTTL > 0 {
+		return lockConfig.LeaseTTL
+	}
+	return defaultLeaseTTL
+}
+
+// leaseConflict rejects options, which need a local lock file, for leases.
+func leaseConflict(killRunning bool) error {
+	if killRunning || opts.MaxConcurrent > 1 {
+		return errors.New("lease needs neither kill running nor max concurrent > 1, holders may run on other hosts")
+	}
+	return nil
+}
+
+// lockPath returns the file of the lock taken by takeLock.
+func lockPath() string {
+	if dir := leaseDir(); dir != "" {
+		return filepath.Join(dir, lockName()+".lease")
+	}
+	return lockFile()
+}
+
+// takeLock takes the lease on the shared lease directory, if configured,
+// and a local lock file otherwise.
+func takeLock(killRunning bool) (Lock, uint, error) {
+	if leaseDir() == "" {
+		return createLock(killRunning)
+	}
+	if err := leaseConflict(killRunning); err != nil {
+		return nil, 0, err
+	}
+	lease, err := createLease(lockPath(), leaseTTL())
+	if err != nil {
+		return nil, 0, err
+	}
+	return lease, 1, nil
+}
+
+// slotFile returns the lock file of slot, numbered from 1. Slot 1 is the lock
+// file of a single instance, further slots are NAME.2.lock to NAME.N.lock.
+func slotFile(slot uint) string {
+	return lockSlotFile(lockFile(), slot)
+}
+
+// lockSlotFile returns the lock file of slot, given filename of slot 1.
+func lockSlotFile(filename string, slot uint) string {
+	if slot <= 1 {
+		return filename
+	}
+	return fmt.Sprintf("%s.%d.lock", strings.TrimSuffix(filename, ".lock"), slot)
+}
+
+// Create a new lock file in the first free of --max-concurrent slots.
+// Ensures that only that many of these command run concurrently on this
+// machine.  Also cleans up stale locks of dead instances.
+// Returns lockfile.ErrBusy only, if all slots are taken.
+func createLock(killRunning bool) (lockfile.Lockfile, uint, error) {
+	slots := opts.MaxConcurrent
+	if slots == 0 {
+		slots = 1
+	}
+	for slot := uint(1); ; slot++ {
+		lock, err := lockSlot(slotFile(slot), killRunning)
+		if err != lockfile.ErrBusy || slot >= slots {
+			return lock, slot, err
+		}
+	}
+}
+
+// lockPollInterval is how often --lock-wait tries to take the lock again.
+var lockPollInterval = time.Second
+
+// waitForLock tries to take the lock until it is free or until has passed.
+func waitForLock(until time.Time) (Lock, uint, error) {
+	logged := false
+	for {
+		lock, slot, err := takeLock(false)
+		wait := until.Sub(time.Now())
+		if err != lockfile.ErrBusy || wait <= 0 {
+			return lock, slot, err
+		}
+		if !logged {
+			log.Println("INFO: lock busy, waiting for it until", until.Format("15:04:05"))
+			logged = true
+		}
+		if wait > lockPollInterval {
+			wait = lockPollInterval
+		}
+		time.Sleep(wait)
+	}
+}
+
+// eventFile returns the file next to lock file filename, which records the
+// monitoring event taking the lock, since several events may share a lock name.
+func eventFile(filename string) string {
+	return filename + ".event"
+}
+
+// groupFile returns the file next to lock file filename, which records the
+// process group of the command run under the lock.
+func groupFile(filename string) string {
+	return filename + ".pgid"
+}
+
+// recordGroup notes the process group of the command run under lock, so
+// --kill-running can stop it, even if the instance holding the lock is gone.
+func recordGroup(lock Lock, pgid int) {
+	lf, ok := lock.(lockfile.Lockfile)
+	if !ok {
+		return
+	}
+	if err := ioutil.WriteFile(groupFile(string(lf)), []byte(fmt.Sprintln(pgid)), 0600); err != nil {
+		log.Println("ERROR: cannot record process group of command:", err)
+	}
+}
+
+// forgetGroup removes the process group recorded by recordGroup.
+func forgetGroup(lock Lock) {
+	if lf, ok := lock.(lockfile.Lockfile); ok {
+		os.Remove(groupFile(string(lf)))
+	}
+}
+
+// lockedGroups returns the process group of the command run under lock file
+// filename, if it is still running.
+func lockedGroups(filename string) []*os.Process {
+	b, err := ioutil.ReadFile(groupFile(filename))
+	if err != nil {
+		return nil
+	}
+	// never our own group or the special ones of PIDs 0 and 1
+	pgid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pgid < 2 || pgid == syscall.Getpgrp() {
+		return nil
+	}
+	grp, err := os.FindProcess(-pgid)
+	if err != nil || WaitForExit(grp, 0) {
+		return nil
+	}
+	return []*os.Process{grp}
+}
+
+// lockSlot takes the lock file filename.
+func lockSlot(filename string, killRunning bool) (lockfile.Lockfile, error) {
 	var zero lockfile.Lockfile
-	filename := filepath.Join(os.TempDir(), "periodicnoise-"+
-		monitoringEvent, monitoringEvent+".lock")
 
 	dirname := filepath.Dir(filename)
 	if err := privateSubdir(dirname); err != nil {
@@ -62,24 +277,39 @@ func createLock(killRunning bool) (lockfile.Lockfile, error) {
 			if err != nil {
 				return zero, err
 			}
-			if err := process.Kill(); err != nil {
-				return zero, err
-			}
-			// FIXME(mlafeldt) Remove old lock. Not really safe as
-			// the process might not be killed yet. lockfile.Unlock()
-			// should check if it actually holds the lock.
-			if err := lock.Unlock(); err != nil {
-				return zero, err
+			// the running instance passes SIGTERM on to its command and
+			// kills it after its grace time, so give it a bit longer.
+			// Its command has a process group of its own, so it is stopped
+			// directly, in case the instance dies before it.
+			if err := StopProcess(process, opts.GraceTime+time.Second, lockedGroups(filename)...); err != nil {
+				return zero, fmt.Errorf("cannot stop running instance %d: %s", process.Pid, err)
 			}
-			// Create new lock
+			// the lock file of a dead owner is stale and replaced by TryLock
 			if err := lock.TryLock(); err != nil {
 				return zero, err
 			}
+			Replaced(process.Pid)
 		} else {
 			return zero, err
 		}
 	}
 
+	// the command of an instance, which died without cleaning up, may still run
+	if groups := lockedGroups(filename); len(groups) > 0 {
+		if !killRunning {
+			lock.Unlock()
+			return zero, lockfile.ErrBusy
+		}
+		if err := StopProcess(groups[0], opts.GraceTime); err != nil {
+			lock.Unlock()
+			return zero, fmt.Errorf("cannot stop command of dead instance: %s", err)
+		}
+	}
+	os.Remove(groupFile(filename))
+	if err := ioutil.WriteFile(eventFile(filename), []byte(monitoringEvent+"\n"), 0600); err != nil {
+		log.Println("ERROR: cannot record event taking the lock:", err)
+	}
+
 	// Lock successfully created
 	return lock, err
 }
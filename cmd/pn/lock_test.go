@@ -1,19 +1,30 @@
 package main
 
 import (
-	"github.com/nightlyone/lockfile"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+	"github.com/vaughan0/go-ini"
 )
 
 func TestLocking(t *testing.T) {
 	monitoringEvent = "TestLocking"
-	lf, err := createLock(false)
+	lf, _, err := createLock(false)
 	if err != nil {
 		t.Fatal("environment problem: ", err)
 		return
 	}
 	t.Log("Got lockfile")
-	if lf2, err := createLock(false); err == nil {
+	if lf2, _, err := createLock(false); err == nil {
 		t.Errorf("got lockfile, but expected '%v'", lockfile.ErrBusy)
 		lf2.Unlock()
 	} else if err != lockfile.ErrBusy {
@@ -23,7 +34,7 @@ func TestLocking(t *testing.T) {
 	}
 	lf.Unlock()
 
-	lf3, err := createLock(false)
+	lf3, _, err := createLock(false)
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	} else {
@@ -31,3 +42,360 @@ func TestLocking(t *testing.T) {
 		lf3.Unlock()
 	}
 }
+
+func TestLockFile(t *testing.T) {
+	oldopts, oldConfig, oldEvent := opts, lockConfig, monitoringEvent
+	defer func() { opts, lockConfig, monitoringEvent = oldopts, oldConfig, oldEvent }()
+	monitoringEvent = "backup_db"
+
+	want := filepath.Join(os.TempDir(), "periodicnoise-backup_db", "backup_db.lock")
+	if got := lockFile(); got != want {
+		t.Errorf("default: got %s, want %s", got, want)
+	}
+
+	lockConfig.Dir, lockConfig.Name = "/var/lock/pn", "db"
+	if got, want := lockFile(), "/var/lock/pn/periodicnoise-db/db.lock"; got != want {
+		t.Errorf("config: got %s, want %s", got, want)
+	}
+
+	opts.LockDir, opts.LockName = "/run/periodicnoise", "touches_db"
+	if got, want := lockFile(), "/run/periodicnoise/periodicnoise-touches_db/touches_db.lock"; got != want {
+		t.Errorf("flags: got %s, want %s", got, want)
+	}
+
+	opts.LockDir = "locks"
+	wd, _ := os.Getwd()
+	if got, want := lockFile(), filepath.Join(wd, "locks/periodicnoise-touches_db/touches_db.lock"); got != want {
+		t.Errorf("relative: got %s, want %s", got, want)
+	}
+}
+
+func TestLockConfig(t *testing.T) {
+	oldConfig := lockConfig
+	defer func() { lockConfig = oldConfig }()
+
+	config, err := ini.Load(strings.NewReader(`
+[lock]
+dir  = /run/periodicnoise
+name = touches_db
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fillLock(config); err != nil {
+		t.Fatal(err)
+	}
+	if lockConfig.Dir != "/run/periodicnoise" || lockConfig.Name != "touches_db" {
+		t.Errorf("got %+v", lockConfig)
+	}
+
+	config, _ = ini.Load(strings.NewReader("[lock]\nname = ../etc\n"))
+	if err := fillLock(config); err == nil {
+		t.Error("want error for lock name outside lock directory")
+	}
+}
+
+func TestSharedLockName(t *testing.T) {
+	oldopts, oldEvent := opts, monitoringEvent
+	defer func() { opts, monitoringEvent = oldopts, oldEvent }()
+
+	dir, err := ioutil.TempDir("", "TestSharedLockName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts.LockDir, opts.LockName = dir, "touches_db"
+
+	monitoringEvent = "backup_db"
+	lf, _, err := createLock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Unlock()
+
+	// pretend the lock is held by another running process
+	if err := ioutil.WriteFile(string(lf), []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	monitoringEvent = "vacuum_db"
+	if lf2, _, err := createLock(false); err != lockfile.ErrBusy {
+		t.Errorf("got %v, want %v", err, lockfile.ErrBusy)
+		if err == nil {
+			lf2.Unlock()
+		}
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	oldopts, oldEvent := opts, monitoringEvent
+	defer func() { opts, monitoringEvent = oldopts, oldEvent }()
+
+	dir, err := ioutil.TempDir("", "TestMaxConcurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts.LockDir, opts.MaxConcurrent = dir, 2
+	monitoringEvent = "backup_db"
+
+	for want := uint(1); want <= 2; want++ {
+		lf, slot, err := createLock(false)
+		if err != nil {
+			t.Fatalf("slot %d: %v", want, err)
+		}
+		if slot != want {
+			t.Errorf("got slot %d, want %d", slot, want)
+		}
+		// pretend the slot is held by another running process
+		if err := ioutil.WriteFile(string(lf), []byte("1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if lf, _, err := createLock(false); err != lockfile.ErrBusy {
+		t.Errorf("all slots taken: got %v, want %v", err, lockfile.ErrBusy)
+		if err == nil {
+			lf.Unlock()
+		}
+	}
+
+	want := filepath.Join(dir, "periodicnoise-backup_db", "backup_db.2.lock")
+	if got := slotFile(2); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestWaitForLock(t *testing.T) {
+	oldopts, oldEvent, oldInterval := opts, monitoringEvent, lockPollInterval
+	defer func() { opts, monitoringEvent, lockPollInterval = oldopts, oldEvent, oldInterval }()
+
+	dir, err := ioutil.TempDir("", "TestWaitForLock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts.LockDir, opts.MaxConcurrent = dir, 1
+	monitoringEvent = "backup_db"
+	lockPollInterval = 10 * time.Millisecond
+
+	// pretend the lock is held by another running process
+	filename := lockFile()
+	if err := privateSubdir(filepath.Dir(filename)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, _, err := waitForLock(start.Add(50 * time.Millisecond)); err != lockfile.ErrBusy {
+		t.Errorf("got %v, want %v", err, lockfile.ErrBusy)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("gave up after %s, want to wait 50ms", waited)
+	}
+
+	// the other process finishes
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		os.Remove(filename)
+	}()
+	lf, _, err := waitForLock(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal("want lock, got", err)
+	}
+	lf.Unlock()
+}
+
+func TestKillRunning(t *testing.T) {
+	oldopts, oldEvent := opts, monitoringEvent
+	defer func() { opts, monitoringEvent = oldopts, oldEvent }()
+
+	dir, err := ioutil.TempDir("", "TestKillRunning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts.LockDir, opts.MaxConcurrent = dir, 1
+	opts.GraceTime = 200 * time.Millisecond
+	opts.NoMonitoring = true
+	monitoringEvent = "backup_db"
+
+	// a stuck instance holding the lock
+	stuck := startGroup(t, `trap "" TERM; sleep 10; sleep 10`)
+	filename := lockFile()
+	if err := privateSubdir(filepath.Dir(filename)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(fmt.Sprintln(stuck.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lf, _, err := createLock(true)
+	if err != nil {
+		t.Fatal("want lock, got", err)
+	}
+	defer lf.Unlock()
+
+	if !WaitForExit(stuck.Process, 0) {
+		t.Error("stuck instance still alive")
+	}
+	if owner, err := lf.GetOwner(); err != nil || owner.Pid != os.Getpid() {
+		t.Errorf("got owner %v, %v, want us", owner, err)
+	}
+}
+
+// TestHelperStuckInstance is not a real test, but a running instance of pn
+// holding the lock for TestKillRunningGraceful and TestKillRunningStopsCommand.
+// It runs in the process group of the test, so it is not a group leader.
+func TestHelperStuckInstance(t *testing.T) {
+	dir := os.Getenv("PN_TEST_LOCK_DIR")
+	if dir == "" {
+		return
+	}
+	opts.LockDir, opts.MaxConcurrent = dir, 1
+	opts.Timeout, opts.GraceTime = time.Minute, 5*time.Second
+	monitoringEvent = "backup_db"
+	script := `trap "echo graceful > $PN_TEST_LOCK_DIR/terminated; exit 0" TERM; sleep 10 & wait`
+	if os.Getenv("PN_TEST_IGNORE_TERM") != "" {
+		// outlasts the grace time of the instance taking over
+		opts.GraceTime = 30 * time.Second
+		script = `trap "" TERM; sleep 10; sleep 10`
+	}
+	CoreLoopOnce([]string{"sh", "-c", script}, ioutil.Discard)
+	os.Exit(0)
+}
+
+// startStuckInstance runs TestHelperStuckInstance with the lock in dir and
+// waits for it to run its command.
+func startStuckInstance(t *testing.T, dir string, env ...string) *exec.Cmd {
+	stuck := exec.Command(os.Args[0], "-test.run=TestHelperStuckInstance")
+	stuck.Env = append(append(os.Environ(), "PN_TEST_LOCK_DIR="+dir), env...)
+	if err := stuck.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go stuck.Wait()
+
+	for i := 0; ; i++ {
+		if owner, err := lockfile.Lockfile(lockFile()).GetOwner(); err == nil && owner.Pid == stuck.Process.Pid {
+			break
+		} else if i > 100 {
+			stuck.Process.Kill()
+			t.Fatal("stuck instance didn't take the lock")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	return stuck
+}
+
+func TestKillRunningGraceful(t *testing.T) {
+	oldopts, oldEvent := opts, monitoringEvent
+	defer func() { opts, monitoringEvent = oldopts, oldEvent }()
+
+	dir, err := ioutil.TempDir("", "TestKillRunningGraceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts.LockDir, opts.MaxConcurrent = dir, 1
+	opts.GraceTime = 5 * time.Second
+	opts.NoMonitoring = true
+	monitoringEvent = "backup_db"
+
+	startStuckInstance(t, dir)
+
+	start := time.Now()
+	lf, _, err := createLock(true)
+	if err != nil {
+		t.Fatal("want lock, got", err)
+	}
+	defer lf.Unlock()
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("took %s, want command to terminate gracefully before grace time", took)
+	}
+	if got := readFile(t, filepath.Join(dir, "terminated")); got != "graceful\n" {
+		t.Errorf("got %q, want command to catch SIGTERM", got)
+	}
+}
+
+func TestKillRunningStopsCommand(t *testing.T) {
+	oldopts, oldEvent := opts, monitoringEvent
+	defer func() { opts, monitoringEvent = oldopts, oldEvent }()
+
+	dir, err := ioutil.TempDir("", "TestKillRunningStopsCommand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts.LockDir, opts.MaxConcurrent = dir, 1
+	opts.GraceTime = 300 * time.Millisecond
+	opts.NoMonitoring = true
+	monitoringEvent = "backup_db"
+
+	stuck := startStuckInstance(t, dir, "PN_TEST_IGNORE_TERM=1")
+	b, err := ioutil.ReadFile(groupFile(lockFile()))
+	if err != nil {
+		stuck.Process.Kill()
+		t.Fatal("want process group of command recorded, got", err)
+	}
+	pgid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	defer syscall.Kill(-pgid, syscall.SIGKILL)
+
+	lf, _, err := createLock(true)
+	if err != nil {
+		t.Fatal("want lock, got", err)
+	}
+	defer lf.Unlock()
+
+	if !WaitForExit(stuck.Process, 0) {
+		t.Error("stuck instance still alive")
+	}
+	if err := syscall.Kill(-pgid, 0); err != syscall.ESRCH {
+		t.Errorf("got %v, want command of stuck instance stopped", err)
+	}
+}
+
+func TestLockSlotBusyWithCommandOfDeadInstance(t *testing.T) {
+	oldopts, oldEvent := opts, monitoringEvent
+	defer func() { opts, monitoringEvent = oldopts, oldEvent }()
+
+	dir, err := ioutil.TempDir("", "TestLockSlotBusyWithCommandOfDeadInstance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts.LockDir, opts.MaxConcurrent = dir, 1
+	opts.GraceTime = 300 * time.Millisecond
+	monitoringEvent = "backup_db"
+
+	// the command survived its instance, which left a stale lock
+	command := startGroup(t, "sleep 10")
+	defer command.Process.Kill()
+	filename := lockFile()
+	if err := privateSubdir(filepath.Dir(filename)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte("2147483647\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(groupFile(filename), []byte(fmt.Sprintln(command.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := lockSlot(filename, false); err != lockfile.ErrBusy {
+		t.Errorf("got %v, want %v", err, lockfile.ErrBusy)
+	}
+
+	lf, err := lockSlot(filename, true)
+	if err != nil {
+		t.Fatal("want lock, got", err)
+	}
+	defer lf.Unlock()
+	if !WaitForExit(command.Process, 0) {
+		t.Error("command of dead instance still alive")
+	}
+	if _, err := os.Stat(groupFile(filename)); !os.IsNotExist(err) {
+		t.Errorf("want recorded process group removed, got %v", err)
+	}
+}
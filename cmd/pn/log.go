@@ -1,34 +1,254 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/Jimdo/periodicnoise/journal"
 	"github.com/Jimdo/periodicnoise/syslog"
 )
 
-// this enables testing
+// configured in the syslog section of our config, local syslog daemon by default
 var logNetwork, logRemoteAddress string
 
+// logFraming delimits syslog messages over TCP, if configured
+var logFraming *syslog.Framing
+
+// syslogTLS configures CA and client certificate for logNetwork "tcp+tls"
+var syslogTLS struct {
+	CAFile, CertFile, KeyFile string
+}
+
+// syslogTLSConfig loads the files configured in syslogTLS.
+func syslogTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if syslogTLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(syslogTLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", syslogTLS.CAFile)
+		}
+	}
+	if syslogTLS.CertFile != "" || syslogTLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(syslogTLS.CertFile, syslogTLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// dialSyslog connects to the configured syslog daemon
+func dialSyslog() (*syslog.Writer, error) {
+	priority := opts.SyslogFacility.Priority | syslog.LOG_NOTICE
+	if logNetwork != "tcp+tls" {
+		return syslog.Dial(logNetwork, logRemoteAddress, priority, monitoringEvent)
+	}
+	config, err := syslogTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return syslog.DialTLS(logRemoteAddress, config, priority, monitoringEvent)
+}
+
+// logQueueSize enables logging to syslog in the background with a queue of this size
+var logQueueSize int
+
+// logSpool keeps messages, which cannot be sent to syslog, for the next invocation
+var logSpool bool
+
+// asyncLogger delivers messages queued for syslog
+var asyncLogger *syslog.AsyncWriter
+
+// spoolFile keeps messages for syslog of the monitoring event
+func spoolFile() string {
+	return filepath.Join(historyDir(), monitoringEvent+".spool")
+}
+
+// asyncSyslog queues messages for w, so logging does not block the command.
+func asyncSyslog(w *syslog.Writer) (*syslog.AsyncWriter, error) {
+	var spool string
+	if logSpool {
+		if err := privateSubdir(historyDir()); err != nil {
+			return nil, err
+		}
+		spool = spoolFile()
+	}
+	return syslog.NewAsync(w, logQueueSize, spool), nil
+}
+
+// closeLogger delivers pending log messages
+func closeLogger() {
+	if asyncLogger == nil {
+		return
+	}
+	err := asyncLogger.Close()
+	asyncLogger = nil
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		log.Println("ERROR: syslog:", err)
+	}
+}
+
 // derive logger
 func getLogger(useSyslog bool) (logger io.Writer, err error) {
 	if useSyslog {
-		logger, err = syslog.Dial(logNetwork, logRemoteAddress, syslog.LOG_DAEMON|syslog.LOG_NOTICE, monitoringEvent)
-	} else {
-		logger = os.Stderr
-		log.SetPrefix(monitoringEvent + ": ")
+		var w *syslog.Writer
+		w, err = dialSyslog()
+		if err != nil {
+			return nil, err
+		}
+		w.SetFormat(opts.SyslogFormat.Format)
+		if logFraming != nil {
+			w.SetFraming(*logFraming)
+		}
+		var sl structuredLogger = w
+		if logQueueSize > 0 {
+			asyncLogger, err = asyncSyslog(w)
+			if err != nil {
+				return nil, err
+			}
+			sl = asyncLogger
+		}
+		log.SetOutput(&levelWriter{w: sl})
+		return &LineWriter{w: sl}, nil
+	}
+
+	if opts.UseJournal {
+		c, err := journal.Dial(journalPath)
+		if err != nil {
+			return nil, err
+		}
+		j := &journalLogger{c: c, stream: "pn"}
+		log.SetOutput(j)
+		return &LineWriter{w: j}, nil
+	}
+
+	logger = os.Stderr
+	if opts.LogFile != "" {
+		f, err := OpenRotatingFile(logFileName(opts.LogFile), int64(opts.LogFileSize), int(opts.LogFileKeep))
+		if err != nil {
+			return nil, err
+		}
+		reopenOnHangup(f)
+		logger = f
+	}
+	if opts.LogFormat == "json" {
+		j := newJSONLogger(logger)
+		log.SetOutput(j)
+		return &LineWriter{w: j}, nil
+	}
+	log.SetPrefix(monitoringEvent + ": ")
+	log.SetOutput(logger)
+	return &LineWriter{w: logger}, nil
+}
+
+// severities of syslog messages by stream of the command or level of our
+// own messages, configured in the syslog section of our config
+var logSeverities = map[string]syslog.Priority{
+	"stdout":  syslog.LOG_INFO,
+	"stderr":  syslog.LOG_ERR,
+	"fatal":   syslog.LOG_CRIT,
+	"error":   syslog.LOG_ERR,
+	"warning": syslog.LOG_WARNING,
+	"info":    syslog.LOG_INFO,
+}
+
+// levels of our own messages, e.g. "FATAL: cannot contact syslog"
+var logLevels = []string{"fatal", "error", "warning", "info"}
+
+// levelWriter logs our own messages at the severity of their level.
+type levelWriter struct {
+	w structuredLogger
+}
+
+func (l *levelWriter) Write(p []byte) (int, error) {
+	return l.w.Structured(messageSeverity(p), "pn", structuredData("")).Write(p)
+}
+
+// messageSeverity determines the severity of our own message p by its level.
+func messageSeverity(p []byte) syslog.Priority {
+	for _, level := range logLevels {
+		if bytes.HasPrefix(p, []byte(strings.ToUpper(level)+":")) {
+			return logSeverities[level]
+		}
+	}
+	return syslog.LOG_NOTICE
+}
+
+// sdID identifies our STRUCTURED-DATA in syslog messages. The default uses the
+// enterprise number reserved for documentation (RFC 5612), so sites should set
+// sd_id in the syslog section to one with their own private enterprise number.
+var sdID = "pn@32473"
+
+// validSDID checks, that id is an SD-ID of the form NAME@ENTERPRISENUMBER.
+func validSDID(id string) error {
+	i := strings.IndexByte(id, '@')
+	_, err := strconv.ParseUint(id[i+1:], 10, 32)
+	invalid := strings.IndexFunc(id, func(c rune) bool {
+		return c <= ' ' || c >= 127 || c == '=' || c == ']' || c == '"'
+	})
+	if i < 1 || err != nil || invalid >= 0 || len(id) > 32 {
+		return fmt.Errorf("invalid sd_id %q, want NAME@ENTERPRISENUMBER", id)
+	}
+	return nil
+}
+
+// structuredLogger is implemented by syslog.Writer and syslog.AsyncWriter
+type structuredLogger interface {
+	io.Writer
+	Structured(p syslog.Priority, msgID string, data ...syslog.SDElement) *syslog.StructuredWriter
+}
+
+// streamLogger returns a logger for lines of stream, e.g. "stdout".
+// Syslog and JSON messages get tagged with monitoring event, attempt and stream.
+func streamLogger(logger io.Writer, stream string) io.Writer {
+	lw, ok := logger.(*LineWriter)
+	if !ok {
+		return logger
+	}
+	switch w := lw.w.(type) {
+	case structuredLogger:
+		return &LineWriter{w: w.Structured(logSeverities[stream], stream, structuredData(stream))}
+	case *jsonLogger:
+		return &LineWriter{w: w.forStream(stream)}
+	case *journalLogger:
+		return &LineWriter{w: w.forStream(stream)}
+	}
+	return logger
+}
+
+// structuredData tags syslog messages with monitoring event, attempt and stream, if any.
+func structuredData(stream string) syslog.SDElement {
+	e := syslog.SDElement{
+		ID: sdID,
+		Params: []syslog.SDParam{
+			{Name: "event", Value: monitoringEvent},
+			{Name: "attempt", Value: strconv.FormatUint(uint64(currentRun.Attempts), 10)},
+		},
 	}
-	if err == nil {
-		log.SetOutput(logger)
+	if stream != "" {
+		e.Params = append(e.Params, syslog.SDParam{Name: "stream", Value: stream})
 	}
-	return &LineWriter{w: logger}, err
+	return e
 }
 
 func canContinue(expire time.Time, progressed bool, err error) bool {
@@ -86,13 +306,14 @@ func connectOutputs(cmd *exec.Cmd, logger io.Writer, wg *sync.WaitGroup) error {
 		if err != nil {
 			return &StartupError{"connecting stdout", err}
 		}
+		// keep the beginning of the output for the run history
+		outputHead = NewCapWriter(historyOutputSize)
+		output := io.TeeReader(stdout, outputHead)
 		if opts.WrapNagiosPlugin {
 			firstbytes = NewCapWriter(8192)
-			stdout := io.TeeReader(stdout, firstbytes)
-			logStream(stdout, logger, wg)
-		} else {
-			logStream(stdout, logger, wg)
+			output = io.TeeReader(output, firstbytes)
 		}
+		logStream(output, streamLogger(logger, "stdout"), wg)
 	} else if opts.WrapNagiosPlugin {
 		stdout, err := cmd.StdoutPipe()
 		if err != nil {
@@ -107,7 +328,7 @@ func connectOutputs(cmd *exec.Cmd, logger io.Writer, wg *sync.WaitGroup) error {
 		if err != nil {
 			return &StartupError{"connecting stderr", err}
 		}
-		logStream(stderr, logger, wg)
+		logStream(stderr, streamLogger(logger, "stderr"), wg)
 	}
 	return nil
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jimdo/periodicnoise/syslog"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestStreamLoggerStructuredData(t *testing.T) {
+	oldEvent, oldRun := monitoringEvent, currentRun
+	defer func() { monitoringEvent, currentRun = oldEvent, oldRun }()
+	monitoringEvent = "backup_db"
+	currentRun.Attempts = 2
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w, err := syslog.Dial("udp", conn.LocalAddr().String(), syslog.LOG_DAEMON|syslog.LOG_NOTICE, monitoringEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetFormat(syslog.FormatRFC5424)
+
+	logger := streamLogger(&LineWriter{w: w}, "stderr")
+	if _, err := io.WriteString(logger, "disk full\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	want := ` stderr [pn@32473 event="backup_db" attempt="2" stream="stderr"] disk full` + "\n"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want suffix %q", got, want)
+	}
+	// LOG_DAEMON|LOG_ERR
+	if !strings.HasPrefix(got, "<27>1 ") {
+		t.Errorf("got %q, want stderr at severity err", got)
+	}
+}
+
+func TestStreamLoggerPassThrough(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &LineWriter{w: &buf}
+	if got := streamLogger(logger, "stdout"); got != logger {
+		t.Errorf("got %v, want logger passed through", got)
+	}
+}
+
+func TestSyslogConfig(t *testing.T) {
+	oldNetwork, oldAddress, oldTLS, oldFraming := logNetwork, logRemoteAddress, syslogTLS, logFraming
+	oldQueueSize, oldSpool := logQueueSize, logSpool
+	defer func() {
+		logNetwork, logRemoteAddress, syslogTLS, logFraming = oldNetwork, oldAddress, oldTLS, oldFraming
+		logQueueSize, logSpool = oldQueueSize, oldSpool
+	}()
+
+	config, err := ini.Load(strings.NewReader(`
+[syslog]
+network    = tcp+tls
+address    = logs.example.com:6514
+ca_file    = /etc/ssl/certs/logs-ca.pem
+cert_file  = /etc/periodicnoise/client.pem
+key_file   = /etc/periodicnoise/client.key
+framing    = octet-counting
+queue_size = 1000
+spool      = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fillSyslog(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if logNetwork != "tcp+tls" || logRemoteAddress != "logs.example.com:6514" {
+		t.Errorf("got network %q, address %q", logNetwork, logRemoteAddress)
+	}
+	if syslogTLS.CAFile != "/etc/ssl/certs/logs-ca.pem" ||
+		syslogTLS.CertFile != "/etc/periodicnoise/client.pem" ||
+		syslogTLS.KeyFile != "/etc/periodicnoise/client.key" {
+		t.Errorf("got %+v", syslogTLS)
+	}
+	if logFraming == nil || *logFraming != syslog.FramingOctetCounting {
+		t.Errorf("got framing %v, want octet counting", logFraming)
+	}
+	if logQueueSize != 1000 || !logSpool {
+		t.Errorf("got queue size %d, spool %v", logQueueSize, logSpool)
+	}
+}
+
+func TestSyslogSeverityConfig(t *testing.T) {
+	oldSeverities := logSeverities
+	defer func() { logSeverities = oldSeverities }()
+	logSeverities = map[string]syslog.Priority{}
+	for name, severity := range oldSeverities {
+		logSeverities[name] = severity
+	}
+
+	config, err := ini.Load(strings.NewReader(`
+[syslog]
+severity.stderr = warning
+severity.info   = debug
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fillSyslog(config); err != nil {
+		t.Fatal(err)
+	}
+	if logSeverities["stderr"] != syslog.LOG_WARNING || logSeverities["info"] != syslog.LOG_DEBUG {
+		t.Errorf("got %v", logSeverities)
+	}
+	if logSeverities["stdout"] != syslog.LOG_INFO {
+		t.Errorf("got stdout at %v, want default info", logSeverities["stdout"])
+	}
+
+	for _, bad := range []string{"severity.stdin = info", "severity.stdout = loud"} {
+		config, err := ini.Load(strings.NewReader("[syslog]\n" + bad + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fillSyslog(config); err == nil {
+			t.Errorf("%s: want error, got nil", bad)
+		}
+	}
+}
+
+func TestSyslogSDIDConfig(t *testing.T) {
+	oldSDID := sdID
+	defer func() { sdID = oldSDID }()
+
+	config, err := ini.Load(strings.NewReader("[syslog]\nsd_id = pn@4711\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fillSyslog(config); err != nil {
+		t.Fatal(err)
+	}
+	if got := structuredData("stdout").ID; got != "pn@4711" {
+		t.Errorf("got SD-ID %q, want pn@4711", got)
+	}
+
+	for _, bad := range []string{"pn", "@4711", "pn@example", "pn job@4711", "periodicnoise-structured-data@4711"} {
+		config, err := ini.Load(strings.NewReader("[syslog]\nsd_id = " + bad + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fillSyslog(config); err == nil {
+			t.Errorf("%s: want error, got nil", bad)
+		}
+	}
+}
+
+func TestLevelWriter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w, err := syslog.Dial("udp", conn.LocalAddr().String(), syslog.LOG_CRON|syslog.LOG_NOTICE, "backup_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	lw := &levelWriter{w: w}
+
+	tests := []struct {
+		msg  string
+		want syslog.Priority
+	}{
+		{"FATAL: cannot contact syslog\n", syslog.LOG_CRON | syslog.LOG_CRIT},
+		{"ERROR: cannot record run history\n", syslog.LOG_CRON | syslog.LOG_ERR},
+		{"INFO: delaying start by 3s\n", syslog.LOG_CRON | syslog.LOG_INFO},
+		{"something else\n", syslog.LOG_CRON | syslog.LOG_NOTICE},
+	}
+	buf := make([]byte, 1024)
+	for _, tc := range tests {
+		if _, err := io.WriteString(lw, tc.msg); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf[:n]), fmt.Sprintf("<%d>", tc.want); !strings.HasPrefix(got, want) {
+			t.Errorf("got %q, want priority %s", got, want)
+		}
+	}
+}
+
+func TestSyslogTLSConfig(t *testing.T) {
+	oldTLS := syslogTLS
+	defer func() { syslogTLS = oldTLS }()
+
+	syslogTLS.CAFile, syslogTLS.CertFile, syslogTLS.KeyFile = "", "", ""
+	if config, err := syslogTLSConfig(); err != nil || config.RootCAs != nil || len(config.Certificates) != 0 {
+		t.Errorf("without files: got %+v, %v, want system defaults", config, err)
+	}
+
+	syslogTLS.CAFile = "testdata/config.ini"
+	if _, err := syslogTLSConfig(); err == nil {
+		t.Error("want error for CA file without certificates")
+	}
+
+	syslogTLS.CAFile = "testdata/does-not-exist.pem"
+	if _, err := syslogTLSConfig(); err == nil {
+		t.Error("want error for missing CA file")
+	}
+}
+
+func TestStreamLoggerAsync(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w, err := syslog.Dial("udp", conn.LocalAddr().String(), syslog.LOG_DAEMON|syslog.LOG_NOTICE, "backup_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetFormat(syslog.FormatRFC5424)
+	a := syslog.NewAsync(w, 10, "")
+
+	logger := streamLogger(&LineWriter{w: a}, "stdout")
+	if _, err := io.WriteString(logger, "done\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); !strings.Contains(got, ` stdout [pn@32473 `) {
+		t.Errorf("got %q, want structured data of stream", got)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// RotatingFile is a log file, which is rotated before exceeding maxSize bytes.
+// Rotated files get the suffixes .1 (newest) to .N (oldest), where N is keep.
+type RotatingFile struct {
+	name    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex // guards fields below
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens the log file name for appending, creating it if needed.
+// A maxSize of 0 disables rotation.
+func OpenRotatingFile(name string, maxSize int64, keep int) (*RotatingFile, error) {
+	r := &RotatingFile{name: name, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open must be called with r.mu held or before r is shared.
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p to the log file, rotating it first, if p doesn't fit anymore.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files and starts a new log file.
+// It must be called with r.mu held.
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.keep > 0 {
+		for i := r.keep - 1; i > 0; i-- {
+			// missing files are just not rotated yet
+			os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+		}
+		if err := os.Rename(r.name, r.name+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.name); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Reopen closes and opens the log file again, e.g. after it has been
+// moved away by logrotate.
+func (r *RotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.f.Close()
+	return r.open()
+}
+
+// Close closes the log file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.f.Close()
+}
+
+// logFileName expands %(event) in the log file name.
+func logFileName(name string) string {
+	return strings.Replace(name, "%(event)", monitoringEvent, -1)
+}
+
+// reopenOnHangup reopens r on SIGHUP instead of terminating.
+func reopenOnHangup(r *RotatingFile) {
+	var signals []os.Signal
+	for _, sig := range DeadlySignals {
+		if sig != syscall.SIGHUP {
+			signals = append(signals, sig)
+		}
+	}
+	DeadlySignals = signals
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := r.Reopen(); err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: reopening log file:", err)
+			}
+		}
+	}()
+}
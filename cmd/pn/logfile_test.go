@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+)
+
+func readFile(t *testing.T, name string) string {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRotatingFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "job.log")
+
+	f, err := OpenRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{
+		name:        "fourth\n",
+		name + ".1": "third\n",
+		name + ".2": "second\n",
+	}
+	for file, content := range want {
+		if got := readFile(t, file); got != content {
+			t.Errorf("%s: got %q, want %q", file, got, content)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("want only 2 rotated files, got %v", err)
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRotatingFileAppends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "job.log")
+
+	if err := ioutil.WriteFile(name, []byte("previous run\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenRotatingFile(name, 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("this run\n"))
+	f.Close()
+
+	if got, want := readFile(t, name), "previous run\nthis run\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReopenOnHangup(t *testing.T) {
+	oldSignals := DeadlySignals
+	defer func() { DeadlySignals = oldSignals }()
+
+	dir, err := ioutil.TempDir("", "TestReopenOnHangup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "job.log")
+
+	f, err := OpenRotatingFile(name, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reopenOnHangup(f)
+
+	for _, sig := range DeadlySignals {
+		if sig == syscall.SIGHUP {
+			t.Error("want SIGHUP removed from deadly signals")
+		}
+	}
+
+	// what logrotate does
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+
+	for i := 0; ; i++ {
+		if _, err := os.Stat(name); err == nil {
+			break
+		} else if i > 100 {
+			t.Fatal("log file not reopened after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.Write([]byte("after rotation\n"))
+	if got, want := readFile(t, name), "after rotation\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLogFileName(t *testing.T) {
+	oldEvent := monitoringEvent
+	defer func() { monitoringEvent = oldEvent }()
+	monitoringEvent = "backup_db"
+
+	if got, want := logFileName("/var/log/pn/%(event).log"), "/var/log/pn/backup_db.log"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestLogFileSize(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	tests := map[string]byteSize{
+		"--log-file-size=512K": 512 << 10,
+		"--log-file-size=10M":  10 << 20,
+		"--log-file-size=1g":   1 << 30,
+		"--log-file-size=100":  100,
+	}
+	for arguments, want := range tests {
+		if _, err := flags.ParseArgs(&opts, strings.Fields(arguments+" -- true")); err != nil {
+			t.Errorf("%s: %v", arguments, err)
+		} else if opts.LogFileSize != want {
+			t.Errorf("%s: got %d, want %d", arguments, opts.LogFileSize, want)
+		}
+	}
+
+	if _, err := flags.ParseArgs(&opts, strings.Fields("--log-file-size=10MB -- true")); err == nil {
+		t.Error("want error for invalid size")
+	}
+}
+
+func TestLogFileWithSyslog(t *testing.T) {
+	oldopts := opts
+	defer func() { opts = oldopts }()
+
+	arguments := "--use-syslog --log-file=/tmp/job.log -- true"
+	_, err := flags.ParseArgs(&opts, strings.Fields(arguments))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateOptionConstraints(); err == nil {
+		t.Error("want error, got nil")
+	} else {
+		t.Log("got", err)
+	}
+}
@@ -3,13 +3,17 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
+
+	"github.com/nightlyone/lockfile"
 )
 
 // Ok states that execution went well. Logs debug output and reports ok to
 // monitoring.
-func Ok() {
+func Ok() error {
 	var message string
 	log.Println("OK")
 	if firstbytes == nil {
@@ -17,36 +21,61 @@ func Ok() {
 	} else {
 		message = string(firstbytes.Bytes())
 	}
-	monitor(monitorOk, message)
+	return monitor(monitorOk, message)
 }
 
 // NotAvailable states that the command could not be started successfully. It
 // might not be installed or has other problems.
-func NotAvailable(err error) {
+func NotAvailable(err error) error {
 	s := fmt.Sprint("Cannot start command: ", err)
 	log.Println("FATAL:", s)
-	monitor(monitorUnknown, s)
+	return monitor(monitorUnknown, s)
 }
 
 // TimedOut states that the command took too long and reports failure to the
 // monitoring.
-func TimedOut(err error) {
+func TimedOut(err error) error {
 	s := fmt.Sprint(err)
 	log.Println("FATAL:", s)
-	monitor(monitorCritical, s)
+	return monitor(monitorCritical, s)
 }
 
 // Busy states that the command hangs and reports failure to the monitoring.
 // Those tasks should be automatically killed, if it happens often.
-func Busy() {
+func Busy() error {
 	s := "previous invocation of command still running"
+	if opts.MaxConcurrent > 1 {
+		s = fmt.Sprintf("%d previous invocations of command still running", opts.MaxConcurrent)
+	}
 	log.Println("FATAL:", s)
-	monitor(monitorCritical, s)
+	return monitor(monitorCritical, s)
+}
+
+// Replaced states that a stuck previous invocation has been killed to make
+// room for this one and warns the monitoring about it.
+func Replaced(pid int) {
+	s := fmt.Sprintf("replaced stuck run of command (PID %d)", pid)
+	log.Println("WARNING:", s)
+	if opts.NoMonitoring {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	report := &Report{
+		Event:    monitoringEvent,
+		State:    monitorWarning,
+		Message:  s,
+		SendAs:   opts.SendAs,
+		SendTo:   opts.SendTo,
+		Hostname: hostname,
+	}
+	// the result of this run is still reported as usual
+	notify(monitoringBackends, report)
 }
 
 // Failed states that the command didn't execute successfully and reports
 // failure to the monitoring. Also Logs error output.
-func Failed(err error) {
+func Failed(err error) error {
 	var message string
 	code, s := error2exit(err)
 	log.Printf("INFO: %s (considered %s for monitoring)\n", s, code)
@@ -55,20 +84,29 @@ func Failed(err error) {
 	} else {
 		message = string(firstbytes.Bytes())
 	}
-	monitor(code, message)
+	return monitor(code, message)
 }
 
 // Locked states that we could not get the lock.
-func Locked(err error) {
+func Locked(err error) error {
 	s := fmt.Sprint("Failed to get lock: ", err)
 	log.Println("FATAL:", s)
-	monitor(monitorCritical, s)
+	return monitor(monitorCritical, s)
 }
 
 var firstbytes *CapWriter
 
 func main() {
 	log.SetFlags(0)
+
+	// wrapping a command called "status" works via "pn -- status"
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		if err := runStatus(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalln("FATAL:", err)
+		}
+		return
+	}
+
 	args, e := parseFlags()
 
 	if e != nil {
@@ -91,34 +129,64 @@ func main() {
 		}
 	}
 
+	// config has to be loaded before logging, since it configures syslog
+	loadMonitoringCommands()
+
 	logger, err := getLogger(opts.UseSyslog)
 	if err != nil {
-		log.Fatal("FATAL: cannot contact syslog")
+		log.Fatalln("FATAL: cannot set up logging:", err)
 		return
 	}
+	defer closeLogger()
 
-	loadMonitoringCommands()
+	if opts.DryRun {
+		log.Println("INFO: dry run, would delay start by", ScatterDelay(opts.MaxDelay))
+		return
+	}
 
+	currentRun.Start = time.Now()
 	err = CoreLoopRetry(args, logger)
+	currentRun.Duration = time.Since(currentRun.Start)
+	currentRun.ExitCode = exitCode(err)
+	if err != nil {
+		currentRun.Failure = errorClass(err)
+	}
+
+	var merr error
 	if err == nil {
 		// best case
-		Ok()
+		merr = Ok()
 	} else {
 		// now handle any errors
 		switch e := err.(type) {
 		case *TimeoutError:
-			TimedOut(e)
+			merr = TimedOut(e)
 		case *NotAvailableError:
-			NotAvailable(e)
+			merr = NotAvailable(e)
 		case *StartupError:
-			NotAvailable(e)
+			merr = NotAvailable(e)
 		case *exec.ExitError:
-			Failed(e)
+			merr = Failed(e)
 		case *LockError:
-			Locked(e)
+			if e.err == lockfile.ErrBusy {
+				merr = Busy()
+			} else {
+				merr = Locked(e)
+			}
 		default:
 			// is unknown error really a fail? Shouldn't happend anyway!
-			Failed(e)
+			merr = Failed(e)
 		}
 	}
+
+	if err := recordRun(); err != nil {
+		log.Println("ERROR: cannot record run history:", err)
+	}
+
+	if merr != nil {
+		log.Println("FATAL:", merr)
+		// os.Exit skips deferred calls
+		closeLogger()
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metric is a gauge in the Prometheus text exposition format.
+type metric struct {
+	name, help string
+	value      func(r *Report) float64
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func timestampValue(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// metrics describes the result of a run.
+var metrics = []metric{
+	{"pn_last_start_timestamp_seconds", "Start of the last run as unix timestamp.",
+		func(r *Report) float64 { return timestampValue(r.Start) }},
+	{"pn_last_end_timestamp_seconds", "End of the last run as unix timestamp.",
+		func(r *Report) float64 { return timestampValue(r.End) }},
+	{"pn_last_duration_seconds", "Duration of the last run, including retries.",
+		func(r *Report) float64 { return r.Duration.Seconds() }},
+	{"pn_last_exit_code", "Exit code of the last run, -1 if the command did not exit by itself.",
+		func(r *Report) float64 { return float64(r.ExitCode) }},
+	{"pn_last_success", "Whether the last run has been ok.",
+		func(r *Report) float64 { return boolValue(r.State == monitorOk) }},
+	{"pn_last_retries", "Number of retries in the last run.",
+		func(r *Report) float64 {
+			if r.Attempt == 0 {
+				return 0
+			}
+			return float64(r.Attempt - 1)
+		}},
+	{"pn_last_timed_out", "Whether the last run has been killed after --timeout.",
+		func(r *Report) float64 { return boolValue(r.Failure == errorClassTimeout) }},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// writeMetrics writes the metrics of r in Prometheus text exposition format to w.
+func writeMetrics(w io.Writer, r *Report) error {
+	labels := fmt.Sprintf(`{event="%s"}`, labelEscaper.Replace(r.Event))
+	for _, m := range metrics {
+		value := strconv.FormatFloat(m.value(r), 'f', -1, 64)
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s%s %s\n",
+			m.name, m.help, m.name, m.name, labels, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TextfileBackend writes metrics for the textfile collector of the Prometheus node_exporter.
+type TextfileBackend struct {
+	Dir string
+}
+
+// textfile is configured in the metrics section of our config
+var textfile TextfileBackend
+
+// Enabled reports whether a textfile directory is configured.
+func (t *TextfileBackend) Enabled() bool {
+	return t.Dir != ""
+}
+
+// Notify implements MonitoringBackend.
+// The .prom file is replaced atomically, so the collector never reads partial metrics.
+func (t *TextfileBackend) Notify(r *Report) error {
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, r); err != nil {
+		return err
+	}
+
+	name := "pn_" + r.Event + ".prom"
+	// the collector only reads files ending in .prom
+	tmp, err := ioutil.TempFile(t.Dir, "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(t.Dir, name))
+}
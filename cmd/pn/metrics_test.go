@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	start := time.Unix(1440411873, 500000000)
+	r := &Report{
+		Event:    `backup "db"`,
+		State:    monitorCritical,
+		Start:    start,
+		End:      start.Add(90 * time.Second),
+		Duration: 90 * time.Second,
+		Attempt:  3,
+		ExitCode: -1,
+		Failure:  errorClassTimeout,
+	}
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("\n" + buf.String())
+
+	for _, want := range []string{
+		"# TYPE pn_last_start_timestamp_seconds gauge\n",
+		`pn_last_start_timestamp_seconds{event="backup \"db\""} 1440411873.5` + "\n",
+		`pn_last_end_timestamp_seconds{event="backup \"db\""} 1440411963.5` + "\n",
+		`pn_last_duration_seconds{event="backup \"db\""} 90` + "\n",
+		`pn_last_exit_code{event="backup \"db\""} -1` + "\n",
+		`pn_last_success{event="backup \"db\""} 0` + "\n",
+		`pn_last_retries{event="backup \"db\""} 2` + "\n",
+		`pn_last_timed_out{event="backup \"db\""} 1` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+}
+
+func TestTextfileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pntextfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := TextfileBackend{Dir: dir}
+	if err := backend.Notify(&Report{Event: "backup_db", State: monitorOk, Attempt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, "pn_backup_db.prom")
+	if len(files) != 1 || files[0] != want {
+		t.Fatalf("got files %v, want only %s", files, want)
+	}
+
+	content, err := ioutil.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `pn_last_success{event="backup_db"} 1`) {
+		t.Errorf("want success metric, got\n%s", content)
+	}
+}
+
+func TestMonitorMetricsWithoutMonitoring(t *testing.T) {
+	oldBackends := monitoringBackends
+	oldMetrics := metricsBackends
+	oldOpts := opts
+	defer func() {
+		monitoringBackends = oldBackends
+		metricsBackends = oldMetrics
+		opts = oldOpts
+	}()
+
+	monitoring := &recordingBackend{}
+	metrics := &recordingBackend{}
+	monitoringBackends = []namedBackend{{"monitoring", monitoring}}
+	metricsBackends = []namedBackend{{"metrics", metrics}}
+	opts.NoMonitoring = true
+
+	if err := monitor(monitorCritical, "failed"); err != nil {
+		t.Fatal(err)
+	}
+	if len(monitoring.reports) != 0 {
+		t.Errorf("want no monitoring with --no-monitoring, got %+v", monitoring.reports)
+	}
+	if len(metrics.reports) != 1 || metrics.reports[0].State != monitorCritical {
+		t.Errorf("want metrics with actual state, got %+v", metrics.reports)
+	}
+}
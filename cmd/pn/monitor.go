@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var monitoringCalls = map[monitoringResult]string{}
@@ -98,28 +102,168 @@ func shellEscape(s string) string {
 	return res[1 : len(res)-1]
 }
 
+// Report is a monitoring event, as passed to monitoring backends.
+type Report struct {
+	Event    string
+	State    monitoringResult
+	Message  string
+	SendAs   string
+	SendTo   string
+	Hostname string
+	Start    time.Time
+	End      time.Time
+	Duration time.Duration
+	Attempt  uint
+	ExitCode int
+	Failure  string // class of error, e.g. "timeout", if the command failed
+	// Deadline of pn, backends should not take longer than that, if possible
+	Deadline time.Time
+}
+
+// minReportTimeout is the time a backend gets at least, even if the deadline
+// of pn has passed already, since reports of timeouts matter most.
+var minReportTimeout = time.Second
+
+// Timeout limits the time a backend may take to configured,
+// or less, if the deadline of pn is closer, but not below minReportTimeout.
+func (r *Report) Timeout(configured time.Duration) time.Duration {
+	if r.Deadline.IsZero() {
+		return configured
+	}
+	left := r.Deadline.Sub(time.Now())
+	if left < minReportTimeout {
+		left = minReportTimeout
+	}
+	if left < configured {
+		return left
+	}
+	return configured
+}
+
+// MonitoringBackend delivers reports to a monitoring system.
+type MonitoringBackend interface {
+	Notify(r *Report) error
+}
+
+// failureMode tells how to handle a failing monitoring backend.
+type failureMode int
+
+const (
+	// failureExit makes pn exit non-zero, after all backends have been notified.
+	failureExit failureMode = iota
+	// failureIgnore only logs the failure.
+	failureIgnore
+)
+
+// parseFailureMode reads the on_failure setting of a backend.
+func parseFailureMode(s string) (failureMode, error) {
+	switch s {
+	case "exit":
+		return failureExit, nil
+	case "ignore":
+		return failureIgnore, nil
+	}
+	return failureExit, fmt.Errorf("invalid on_failure %q, want exit or ignore", s)
+}
+
+// namedBackend is a configured monitoring backend.
+type namedBackend struct {
+	name string
+	MonitoringBackend
+}
+
+// monitoringBackends are notified in this order. Monitoring commands
+// are always there, but do nothing for states without a command.
+var monitoringBackends = []namedBackend{
+	{"commands", commandBackend{}},
+}
+
+// metricsBackends are notified like monitoringBackends, but even with --no-monitoring
+// and without --alert-after applied.
+var metricsBackends []namedBackend
+
+// backendFailureModes configures failure handling per backend name. Defaults to failureExit.
+var backendFailureModes = map[string]failureMode{}
+
+// ErrMonitoringFailed happens, when at least one monitoring backend failed and
+// has not been configured to ignore failures.
+var ErrMonitoringFailed = errors.New("monitoring failed")
+
 // Hook for passive monitoring solution
-func monitor(state monitoringResult, message string) {
+func monitor(state monitoringResult, message string) error {
 	if _, exists := monitoringResults[state]; !exists {
 		panic("unknown monitoring state")
 	}
 
-	call, exists := monitoringCalls[state]
-	if !exists || opts.NoMonitoring {
-		return
+	// remember the result for the run history
+	currentRun.Result = state.String()
+
+	hostname, _ := os.Hostname()
+	report := &Report{
+		Event:    monitoringEvent,
+		State:    state,
+		Message:  message,
+		SendAs:   opts.SendAs,
+		SendTo:   opts.SendTo,
+		Hostname: hostname,
+		Start:    currentRun.Start,
+		End:      currentRun.Start.Add(currentRun.Duration),
+		Duration: currentRun.Duration,
+		Attempt:  currentRun.Attempts,
+		ExitCode: currentRun.ExitCode,
+		Failure:  currentRun.Failure,
+	}
+	if !currentRun.Start.IsZero() {
+		report.Deadline = currentRun.Start.Add(opts.Timeout)
+	}
+
+	// metrics always get the actual result
+	err := notify(metricsBackends, report)
+
+	state, alert := alertState(state)
+	if !alert || opts.NoMonitoring {
+		return err
+	}
+
+	report.State = state
+	if merr := notify(monitoringBackends, report); merr != nil {
+		err = merr
 	}
+	return err
+}
+
+// notify passes report to all backends. A failing backend must neither
+// keep the others from being notified nor hide the result of the command.
+func notify(backends []namedBackend, report *Report) (err error) {
+	for _, b := range backends {
+		if berr := b.Notify(report); berr != nil {
+			log.Printf("ERROR: monitoring via %s failed with: %s\n", b.name, berr)
+			if backendFailureModes[b.name] == failureExit {
+				err = ErrMonitoringFailed
+			}
+		}
+	}
+	return err
+}
+
+// commandBackend runs the monitoring commands configured per state via /bin/sh.
+type commandBackend struct{}
 
-	call = strings.Replace(call, "%(event)", shellEscape(monitoringEvent), -1)
-	call = strings.Replace(call, "%(send_to)", shellEscape(opts.SendTo), -1)
-	call = strings.Replace(call, "%(send_as)", shellEscape(opts.SendAs), -1)
-	call = strings.Replace(call, "%(state)", state.String(), -1)
-	call = strings.Replace(call, "%(message)", shellEscape(message), -1)
+// Notify implements MonitoringBackend
+func (commandBackend) Notify(r *Report) error {
+	call, exists := monitoringCalls[r.State]
+	if !exists {
+		return nil
+	}
+
+	call = strings.Replace(call, "%(event)", shellEscape(r.Event), -1)
+	call = strings.Replace(call, "%(send_to)", shellEscape(r.SendTo), -1)
+	call = strings.Replace(call, "%(send_as)", shellEscape(r.SendAs), -1)
+	call = strings.Replace(call, "%(state)", r.State.String(), -1)
+	call = strings.Replace(call, "%(message)", shellEscape(r.Message), -1)
 	// do argument interpolation
 	cmd := commander.Command("/bin/sh", "-c", call)
-	err := cmd.Run()
-	if err != nil {
-		log.Fatalln("FATAL: Monitoring script failed with: ", err)
-	}
+	return cmd.Run()
 }
 
 // Executor provides infrastructure for dependency injection for os.exec Command and run
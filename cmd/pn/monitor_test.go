@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
+	"os"
 	"os/exec"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func setupMonitoringCalls() {
@@ -188,6 +191,79 @@ func TestShellEscaping(t *testing.T) {
 	}
 }
 
+// recordingBackend remembers reports and fails with err
+type recordingBackend struct {
+	reports []Report
+	err     error
+}
+
+func (b *recordingBackend) Notify(r *Report) error {
+	b.reports = append(b.reports, *r)
+	return b.err
+}
+
+func TestMonitorAllBackends(t *testing.T) {
+	oldBackends := monitoringBackends
+	oldModes := backendFailureModes
+	oldEvent := monitoringEvent
+	oldRun := currentRun
+	oldOpts := opts
+	defer func() {
+		monitoringBackends = oldBackends
+		backendFailureModes = oldModes
+		monitoringEvent = oldEvent
+		currentRun = oldRun
+		opts = oldOpts
+	}()
+
+	failing := &recordingBackend{err: errors.New("connection refused")}
+	working := &recordingBackend{}
+	monitoringBackends = []namedBackend{{"failing", failing}, {"working", working}}
+	monitoringEvent = "tests"
+	opts.SendAs = "somehost.example.net"
+	currentRun = RunRecord{Attempts: 2, Duration: time.Minute}
+
+	backendFailureModes = map[string]failureMode{}
+	if err := monitor(monitorWarning, "slow"); err != ErrMonitoringFailed {
+		t.Errorf("got error %v, want %v", err, ErrMonitoringFailed)
+	}
+
+	hostname, _ := os.Hostname()
+	want := Report{Event: "tests", State: monitorWarning, Message: "slow", SendAs: "somehost.example.net",
+		Hostname: hostname, End: time.Time{}.Add(time.Minute), Duration: time.Minute, Attempt: 2}
+	if len(working.reports) != 1 || working.reports[0] != want {
+		t.Errorf("want %+v after failing backend, got %+v", want, working.reports)
+	}
+
+	backendFailureModes = map[string]failureMode{"failing": failureIgnore}
+	if err := monitor(monitorWarning, "slow"); err != nil {
+		t.Errorf("want ignored failure, got %v", err)
+	}
+	if len(failing.reports) != 2 || len(working.reports) != 2 {
+		t.Errorf("want 2 reports for each backend, got %d and %d", len(failing.reports), len(working.reports))
+	}
+}
+
+func TestMonitorCommandFailure(t *testing.T) {
+	oldCalls := monitoringCalls
+	oldEvent := monitoringEvent
+	oldCommander := commander
+	defer func() {
+		monitoringCalls = oldCalls
+		monitoringEvent = oldEvent
+		commander = oldCommander
+	}()
+
+	setupMonitoringCalls()
+	monitoringEvent = "tests"
+	ce := &mockCommanderExecutor{xfail: errors.New("exit status 2")}
+
+	commander = Commander(ce)
+	if err := monitor(monitorCritical, "failed"); err != ErrMonitoringFailed {
+		t.Errorf("got error %v, want %v", err, ErrMonitoringFailed)
+	}
+}
+
 // mock infrastructure for os.exec Command and run
 type mockCommanderExecutor struct {
 	got, want string
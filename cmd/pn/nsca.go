@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+// Sizes of the NSCA protocol, s. common.h of NSCA 2.x
+const (
+	nscaIVSize          = 128
+	nscaInitPacketSize  = nscaIVSize + 4 // IV and timestamp
+	nscaPacketVersion   = 3
+	nscaHostnameSize    = 64
+	nscaDescriptionSize = 128
+	nscaOutputSize      = 512
+	// version, padding, crc32, timestamp, return code, strings and trailing struct padding
+	nscaDataPacketSize = 2 + 2 + 4 + 4 + 2 + nscaHostnameSize + nscaDescriptionSize + nscaOutputSize + 2
+)
+
+// NSCAEncryption is the method used to encrypt packets to the NSCA server.
+type NSCAEncryption int
+
+// Supported encryption methods, numbered like in nsca.cfg
+const (
+	NSCAEncryptNone NSCAEncryption = 0
+	NSCAEncryptXOR  NSCAEncryption = 1
+)
+
+// ParseNSCAEncryption reads encryption method from its name or its number in nsca.cfg.
+func ParseNSCAEncryption(s string) (NSCAEncryption, error) {
+	switch s {
+	case "none", "0":
+		return NSCAEncryptNone, nil
+	case "xor", "1":
+		return NSCAEncryptXOR, nil
+	}
+	return NSCAEncryptNone, fmt.Errorf("unsupported NSCA encryption %q, want none or xor", s)
+}
+
+// NSCAClient sends passive check results to an NSCA server
+// the same way send_nsca does.
+type NSCAClient struct {
+	Host       string
+	Port       string
+	Password   string
+	Encryption NSCAEncryption
+	Timeout    time.Duration
+}
+
+// nsca is configured in the monitoring section of our config
+var nsca = NSCAClient{
+	Port:    "5667",
+	Timeout: 10 * time.Second,
+}
+
+// Enabled reports whether an NSCA server is configured.
+func (c *NSCAClient) Enabled() bool {
+	return c.Host != ""
+}
+
+// Notify implements MonitoringBackend.
+// --send-to overrides the server and --send-as the host we report for.
+// Sending takes no longer than what is left of --timeout.
+func (c *NSCAClient) Notify(r *Report) error {
+	client := *c
+	client.Timeout = r.Timeout(c.Timeout)
+	if r.SendTo != "" {
+		client.Host = r.SendTo
+	}
+	host := r.SendAs
+	if host == "" {
+		host = r.Hostname
+	}
+	return client.Send(host, r.Event, r.State, r.Message)
+}
+
+// Send reports state and message of service on host to the NSCA server.
+func (c *NSCAClient) Send(host, service string, state monitoringResult, message string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(c.Host, c.Port), c.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(c.Timeout)); err != nil {
+		return err
+	}
+
+	init := make([]byte, nscaInitPacketSize)
+	if _, err := io.ReadFull(conn, init); err != nil {
+		return fmt.Errorf("reading NSCA init packet: %s", err)
+	}
+	iv, timestamp := init[:nscaIVSize], binary.BigEndian.Uint32(init[nscaIVSize:])
+
+	packet := nscaPacket(timestamp, host, service, state, message)
+	c.encrypt(packet, iv)
+	_, err = conn.Write(packet)
+	return err
+}
+
+// nscaPacket builds an unencrypted data packet.
+// Strings are truncated to fit and always NUL terminated.
+func nscaPacket(timestamp uint32, host, service string, state monitoringResult, message string) []byte {
+	packet := make([]byte, nscaDataPacketSize)
+	binary.BigEndian.PutUint16(packet[0:], nscaPacketVersion)
+	binary.BigEndian.PutUint32(packet[8:], timestamp)
+
+	code := uint16(state)
+	if state > monitorUnknown {
+		code = uint16(monitorUnknown)
+	}
+	binary.BigEndian.PutUint16(packet[12:], code)
+
+	offset := 14
+	for _, field := range []struct {
+		s    string
+		size int
+	}{
+		{host, nscaHostnameSize},
+		{service, nscaDescriptionSize},
+		{message, nscaOutputSize},
+	} {
+		copy(packet[offset:offset+field.size-1], field.s)
+		offset += field.size
+	}
+
+	// crc32 is calculated with the crc32 field itself set to zero
+	binary.BigEndian.PutUint32(packet[4:], crc32.ChecksumIEEE(packet))
+	return packet
+}
+
+// encrypt packet in place, like encrypt_buffer of NSCA does.
+func (c *NSCAClient) encrypt(packet, iv []byte) {
+	if c.Encryption != NSCAEncryptXOR {
+		return
+	}
+	for i := range packet {
+		packet[i] ^= iv[i%len(iv)]
+	}
+	if len(c.Password) == 0 {
+		return
+	}
+	for i := range packet {
+		packet[i] ^= c.Password[i%len(c.Password)]
+	}
+}
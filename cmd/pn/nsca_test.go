@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+// nscaResult is a check result, as received by the fake NSCA server
+type nscaResult struct {
+	host, service, message string
+	code                   uint16
+	err                    error
+}
+
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// runFakeNSCA accepts one connection and decodes the data packet like the NSCA daemon does.
+func runFakeNSCA(l net.Listener, password string, encryption NSCAEncryption, done chan<- nscaResult) {
+	conn, err := l.Accept()
+	if err != nil {
+		done <- nscaResult{err: err}
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	const timestamp = 1440411873
+	init := make([]byte, nscaInitPacketSize)
+	rand.Read(init[:nscaIVSize])
+	binary.BigEndian.PutUint32(init[nscaIVSize:], timestamp)
+	if _, err := conn.Write(init); err != nil {
+		done <- nscaResult{err: err}
+		return
+	}
+
+	packet := make([]byte, nscaDataPacketSize)
+	if _, err := io.ReadFull(conn, packet); err != nil {
+		done <- nscaResult{err: err}
+		return
+	}
+
+	// XOR encryption is symmetric
+	server := NSCAClient{Password: password, Encryption: encryption}
+	server.encrypt(packet, init[:nscaIVSize])
+
+	var res nscaResult
+	crc := binary.BigEndian.Uint32(packet[4:])
+	binary.BigEndian.PutUint32(packet[4:], 0)
+	if version := binary.BigEndian.Uint16(packet[0:]); version != nscaPacketVersion {
+		res.err = errors.New("wrong packet version")
+	} else if crc != crc32.ChecksumIEEE(packet) {
+		res.err = errors.New("crc32 mismatch")
+	} else if binary.BigEndian.Uint32(packet[8:]) != timestamp {
+		res.err = errors.New("timestamp mismatch")
+	}
+	res.code = binary.BigEndian.Uint16(packet[12:])
+	res.host = cstring(packet[14 : 14+nscaHostnameSize])
+	res.service = cstring(packet[14+nscaHostnameSize : 14+nscaHostnameSize+nscaDescriptionSize])
+	res.message = cstring(packet[14+nscaHostnameSize+nscaDescriptionSize:])
+	done <- res
+}
+
+func TestNSCASend(t *testing.T) {
+	tests := []struct {
+		password   string
+		encryption NSCAEncryption
+	}{
+		{"", NSCAEncryptNone},
+		{"", NSCAEncryptXOR},
+		{"secret", NSCAEncryptXOR},
+	}
+
+	for _, tc := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan nscaResult, 1)
+		go runFakeNSCA(l, tc.password, tc.encryption, done)
+
+		host, port, _ := net.SplitHostPort(l.Addr().String())
+		client := NSCAClient{Host: host, Port: port, Password: tc.password, Encryption: tc.encryption, Timeout: time.Second}
+		message := "disk full; `rm -rf /` $(reboot) %s \"quoted\""
+		if err := client.Send("somehost.example.com", "backup_db", monitorCritical, message); err != nil {
+			t.Fatal(err)
+		}
+
+		res := <-done
+		l.Close()
+		if res.err != nil {
+			t.Errorf("encryption %d: invalid packet: %v", tc.encryption, res.err)
+			continue
+		}
+		want := nscaResult{host: "somehost.example.com", service: "backup_db", message: message, code: 2}
+		if res != want {
+			t.Errorf("encryption %d: got %+v, want %+v", tc.encryption, res, want)
+		}
+	}
+}
+
+func TestNSCAPacketTruncatesOutput(t *testing.T) {
+	packet := nscaPacket(0, "host", "service", monitorOk, strings.Repeat("x", 2*nscaOutputSize))
+	if len(packet) != nscaDataPacketSize {
+		t.Fatalf("got packet of %d bytes, want %d", len(packet), nscaDataPacketSize)
+	}
+	output := cstring(packet[14+nscaHostnameSize+nscaDescriptionSize:])
+	if len(output) != nscaOutputSize-1 {
+		t.Errorf("got output of %d bytes, want %d", len(output), nscaOutputSize-1)
+	}
+}
+
+func TestNSCAConfig(t *testing.T) {
+	oldNSCA := nsca
+	defer func() { nsca = oldNSCA }()
+
+	config, err := ini.Load(strings.NewReader(`
+[monitoring]
+nsca_host       = nagios.example.com
+nsca_password   = secret
+nsca_encryption = xor
+nsca_timeout    = 3s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fillNSCA(config); err != nil {
+		t.Fatal(err)
+	}
+
+	want := NSCAClient{Host: "nagios.example.com", Port: "5667", Password: "secret", Encryption: NSCAEncryptXOR, Timeout: 3 * time.Second}
+	if nsca != want {
+		t.Errorf("got %+v, want %+v", nsca, want)
+	}
+
+	config["monitoring"]["nsca_encryption"] = "3des"
+	if err := fillNSCA(config); err == nil {
+		t.Error("want error for unsupported encryption, got nil")
+	}
+}
+
+func TestNSCANotifyWithinDeadline(t *testing.T) {
+	// a server, which never sends its init packet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	client := NSCAClient{Host: host, Port: port, Timeout: time.Minute}
+	r := &Report{Event: "backup_db", Hostname: "somehost", Deadline: time.Now().Add(-time.Second)}
+
+	start := time.Now()
+	if err := client.Notify(r); err == nil {
+		t.Error("want timeout error, got nil")
+	}
+	if took := time.Since(start); took > minReportTimeout+time.Second {
+		t.Errorf("took %s, want no longer than %s after the deadline", took, minReportTimeout)
+	}
+}
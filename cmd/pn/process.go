@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 // DeadlySignals lists signals, which lead to process termination by default
@@ -52,6 +53,73 @@ func TerminateProcess(p *os.Process) error {
 	return SignalProcess(p, GracefulSignal)
 }
 
+// ErrSurvivedKill is returned, when a process is still alive after SIGKILL.
+var ErrSurvivedKill = errors.New("process survived SIGKILL")
+
+// exitPollInterval is how often WaitForExit checks, whether the process is gone.
+var exitPollInterval = 50 * time.Millisecond
+
+// WaitForExit waits up to timeout for process p to exit, which doesn't need
+// to be our child. It reports whether p is gone.
+func WaitForExit(p *os.Process, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if SignalProcess(p, syscall.Signal(0)) != nil {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(exitPollInterval)
+	}
+}
+
+// waitForAll waits up to timeout for all of ps to exit and reports whether they are gone.
+func waitForAll(ps []*os.Process, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for _, p := range ps {
+		if !WaitForExit(p, deadline.Sub(time.Now())) {
+			return false
+		}
+	}
+	return true
+}
+
+// killTimeout is how long StopProcess waits for processes to be gone after SIGKILL.
+// Orphaned members of a process group are gone only, after init reaped them.
+var killTimeout = 5 * time.Second
+
+// StopProcess gracefully terminates process p and its process group, if p is
+// their leader, as well as groups, e.g. of commands run by p in their own
+// process group. Whatever is still alive after grace gets SIGKILL.
+// Returns nil only, if p and groups are gone.
+func StopProcess(p *os.Process, grace time.Duration, groups ...*os.Process) error {
+	gone := append([]*os.Process{p}, groups...)
+	targets := append([]*os.Process{}, gone...)
+	if grp, err := ProcessGroup(p); err == nil {
+		targets[0] = grp
+	}
+
+	for i, target := range targets {
+		if err := TerminateProcess(target); err != nil && !WaitForExit(gone[i], 0) {
+			return err
+		}
+	}
+	if waitForAll(gone, grace) {
+		return nil
+	}
+
+	for i, target := range targets {
+		if err := KillProcess(target); err != nil && !WaitForExit(gone[i], 0) {
+			return err
+		}
+	}
+	if !waitForAll(gone, killTimeout) {
+		return ErrSurvivedKill
+	}
+	return nil
+}
+
 // ErrNotLeader is returned when we request actions for a process group, but are not their process group leader
 var ErrNotLeader = errors.New("process is not process group leader")
 
@@ -91,7 +159,9 @@ func HasNormalExit(cmd *exec.Cmd) bool {
 	return status.Exited()
 }
 
-func processLife(cmd *exec.Cmd, errc chan error) {
+// processLife runs cmd as leader of a new process group, calling started with
+// its PID, which identifies the group, and reports its exit via errc.
+func processLife(cmd *exec.Cmd, errc chan error, started func(pgid int)) {
 	// FIXME(nightlyone) This works neither in Windows nor Plan9.
 	// Fix it, once we have users of this platform.
 	// NOTE: Cannot setsid and and setpgid in one child. Would need double fork or exec,
@@ -106,6 +176,7 @@ func processLife(cmd *exec.Cmd, errc chan error) {
 			err:  err,
 		}
 	} else {
+		started(cmd.Process.Pid)
 		errc <- cmd.Wait()
 	}
 }
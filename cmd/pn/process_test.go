@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startGroup starts the shell script as leader of a new process group and
+// reaps it in the background, so it doesn't linger as zombie.
+func startGroup(t *testing.T, script string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go cmd.Wait()
+	// let the shell set up its traps
+	time.Sleep(100 * time.Millisecond)
+	return cmd
+}
+
+func TestStopProcessGraceful(t *testing.T) {
+	cmd := startGroup(t, "sleep 10")
+
+	start := time.Now()
+	if err := StopProcess(cmd.Process, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("took %s, want termination without waiting for grace time", took)
+	}
+}
+
+func TestStopProcessEscalates(t *testing.T) {
+	cmd := startGroup(t, `trap "" TERM; sleep 10; sleep 10`)
+
+	start := time.Now()
+	if err := StopProcess(cmd.Process, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Errorf("took %s, want SIGKILL only after grace time", took)
+	}
+	if !WaitForExit(cmd.Process, 0) {
+		t.Error("process still alive")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// PushgatewayBackend pushes metrics to a Prometheus Pushgateway,
+// grouped by monitoring event and hostname.
+type PushgatewayBackend struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// pushgateway is configured in the pushgateway section of our config
+var pushgateway = PushgatewayBackend{
+	Timeout: 10 * time.Second,
+}
+
+// Enabled reports whether a Pushgateway URL is configured.
+func (p *PushgatewayBackend) Enabled() bool {
+	return p.URL != ""
+}
+
+// groupingKey encodes label and value as part of the URL path.
+// Values containing slashes need to be base64 encoded.
+func groupingKey(label, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return label + "@base64/" + base64.URLEncoding.EncodeToString([]byte(value))
+	}
+	return label + "/" + (&url.URL{Path: value}).EscapedPath()
+}
+
+// Notify implements MonitoringBackend.
+// Metrics of the previous push for this event and host are replaced.
+func (p *PushgatewayBackend) Notify(r *Report) error {
+	var body bytes.Buffer
+	if err := writeMetrics(&body, r); err != nil {
+		return err
+	}
+
+	host := r.SendAs
+	if host == "" {
+		host = r.Hostname
+	}
+	target := strings.TrimRight(p.URL, "/") + "/metrics/" +
+		groupingKey("job", r.Event) + "/" + groupingKey("instance", host)
+
+	req, err := http.NewRequest("PUT", target, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := &http.Client{Timeout: r.Timeout(p.Timeout)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("pushgateway returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushgatewayPush(t *testing.T) {
+	var method, path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.EscapedPath()
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	backend := PushgatewayBackend{URL: server.URL + "/", Timeout: time.Second}
+	err := backend.Notify(&Report{
+		Event:    "backup_db",
+		State:    monitorOk,
+		Hostname: "somehost.example.com",
+		Attempt:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if method != "PUT" {
+		t.Errorf("got method %s, want PUT", method)
+	}
+	if want := "/metrics/job/backup_db/instance/somehost.example.com"; path != want {
+		t.Errorf("got path %s, want %s", path, want)
+	}
+	if !strings.Contains(body, `pn_last_success{event="backup_db"} 1`) {
+		t.Errorf("want success metric, got\n%s", body)
+	}
+}
+
+func TestPushgatewayError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "inconsistent metrics", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	backend := PushgatewayBackend{URL: server.URL, Timeout: time.Second}
+	if err := backend.Notify(&Report{Event: "backup_db"}); err == nil {
+		t.Error("want error, got nil")
+	} else {
+		t.Log("got", err)
+	}
+}
+
+func TestGroupingKey(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"backup_db", "job/backup_db"},
+		{"backup db", "job/backup%20db"},
+		{"backup/db", "job@base64/YmFja3VwL2Ri"},
+		{"", "job@base64/"},
+	}
+	for _, tc := range tests {
+		if got := groupingKey("job", tc.value); got != tc.want {
+			t.Errorf("%q: got %s, want %s", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestReportTimeout(t *testing.T) {
+	r := &Report{}
+	if got := r.Timeout(time.Minute); got != time.Minute {
+		t.Errorf("without deadline: got %s, want 1m", got)
+	}
+
+	r.Deadline = time.Now().Add(time.Second)
+	if got := r.Timeout(time.Minute); got > time.Second {
+		t.Errorf("with deadline: got %s, want at most 1s", got)
+	}
+
+	r.Deadline = time.Now().Add(-time.Second)
+	if got := r.Timeout(time.Minute); got != minReportTimeout {
+		t.Errorf("after deadline: got %s, want %s", got, minReportTimeout)
+	}
+	if got := r.Timeout(time.Millisecond); got != time.Millisecond {
+		t.Errorf("after deadline: got %s, want configured 1ms", got)
+	}
+}
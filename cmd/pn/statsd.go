@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// StatsdBackend sends metrics of each run via UDP to StatsD.
+// With DogStatsD, event and host are sent as tags, otherwise
+// they become part of the metric names.
+type StatsdBackend struct {
+	Address   string
+	Prefix    string
+	DogStatsD bool
+}
+
+// statsd is configured in the statsd section of our config
+var statsd = StatsdBackend{
+	Prefix: "pn.",
+}
+
+// Enabled reports whether a StatsD address is configured.
+func (s *StatsdBackend) Enabled() bool {
+	return s.Address != ""
+}
+
+// statsdName replaces characters with special meaning in StatsD.
+var statsdName = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+
+// packet formats the metrics of r, one per line.
+func (s *StatsdBackend) packet(r *Report) []byte {
+	host := r.SendAs
+	if host == "" {
+		host = r.Hostname
+	}
+
+	prefix := s.Prefix
+	suffix := ""
+	if s.DogStatsD {
+		suffix = "|#event:" + statsdName.Replace(r.Event) + ",host:" + statsdName.Replace(host)
+	} else {
+		prefix += statsdName.Replace(r.Event) + "." + statsdName.Replace(host) + "."
+	}
+
+	var buf bytes.Buffer
+	add := func(name string, value int64, kind string) {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		fmt.Fprintf(&buf, "%s%s:%d|%s%s", prefix, name, value, kind, suffix)
+	}
+
+	add("duration", int64(r.Duration/time.Millisecond), "ms")
+	add(strings.ToLower(r.State.String()), 1, "c")
+	if r.Attempt > 1 {
+		add("retries", int64(r.Attempt-1), "c")
+	}
+	switch r.Failure {
+	case errorClassTimeout:
+		add("timeouts", 1, "c")
+	case errorClassLock:
+		add("lock_contention", 1, "c")
+	}
+	return buf.Bytes()
+}
+
+// Notify implements MonitoringBackend.
+// All metrics are sent in one datagram, so there is no partial delivery.
+func (s *StatsdBackend) Notify(r *Report) error {
+	address := s.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "8125")
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(s.packet(r))
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestStatsdPacket(t *testing.T) {
+	r := &Report{
+		Event:    "backup_db",
+		State:    monitorCritical,
+		Hostname: "somehost.example.com",
+		Duration: 1500 * time.Millisecond,
+		Attempt:  3,
+		Failure:  errorClassTimeout,
+	}
+
+	tests := []struct {
+		backend StatsdBackend
+		want    string
+	}{
+		{StatsdBackend{Prefix: "pn."}, strings.Join([]string{
+			"pn.backup_db.somehost_example_com.duration:1500|ms",
+			"pn.backup_db.somehost_example_com.critical:1|c",
+			"pn.backup_db.somehost_example_com.retries:2|c",
+			"pn.backup_db.somehost_example_com.timeouts:1|c",
+		}, "\n")},
+		{StatsdBackend{Prefix: "pn.", DogStatsD: true}, strings.Join([]string{
+			"pn.duration:1500|ms|#event:backup_db,host:somehost_example_com",
+			"pn.critical:1|c|#event:backup_db,host:somehost_example_com",
+			"pn.retries:2|c|#event:backup_db,host:somehost_example_com",
+			"pn.timeouts:1|c|#event:backup_db,host:somehost_example_com",
+		}, "\n")},
+	}
+	for _, tc := range tests {
+		if got := string(tc.backend.packet(r)); got != tc.want {
+			t.Errorf("%+v: got\n%s\nwant\n%s", tc.backend, got, tc.want)
+		}
+	}
+}
+
+func TestStatsdLockContention(t *testing.T) {
+	backend := StatsdBackend{Prefix: "pn.", DogStatsD: true}
+	got := string(backend.packet(&Report{
+		Event:    "backup_db",
+		State:    monitorCritical,
+		Hostname: "somehost",
+		Failure:  errorClassLock,
+	}))
+	if !strings.Contains(got, "pn.lock_contention:1|c") {
+		t.Errorf("want lock contention counter, got\n%s", got)
+	}
+	if strings.Contains(got, "retries") {
+		t.Errorf("want no retries counter for a single attempt, got\n%s", got)
+	}
+}
+
+func TestStatsdSend(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	backend := StatsdBackend{Address: conn.LocalAddr().String(), Prefix: "pn.", DogStatsD: true}
+	err = backend.Notify(&Report{
+		Event:    "backup_db",
+		State:    monitorOk,
+		Hostname: "somehost",
+		Attempt:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "pn.duration:0|ms|#event:backup_db,host:somehost\npn.ok:1|c|#event:backup_db,host:somehost"
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestStatsdConfig(t *testing.T) {
+	oldStatsd := statsd
+	defer func() { statsd = oldStatsd }()
+
+	config, err := ini.Load(strings.NewReader(`
+[statsd]
+address   = localhost:8125
+prefix    = cron.
+dogstatsd = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fillStatsd(config); err != nil {
+		t.Fatal(err)
+	}
+
+	want := StatsdBackend{Address: "localhost:8125", Prefix: "cron.", DogStatsD: true}
+	if statsd != want {
+		t.Errorf("got %+v, want %+v", statsd, want)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/nightlyone/lockfile"
+)
+
+var statusOpts struct {
+	LockDir  string `long:"lock-dir" description:"look for lock files below this directory, e.g. /run/periodicnoise (defaults to dir in lock section of config)"`
+	StateDir string `long:"state-dir" description:"also look for run history below this directory, e.g. /var/lib/periodicnoise"`
+}
+
+// JobStatus describes what is known about a monitoring event on this host.
+type JobStatus struct {
+	Event       string
+	Locked      bool
+	Owners      []int         // PIDs of lock owners by slot, if locked
+	Running     time.Duration // time since the oldest lock has been taken, if locked
+	LastRun     *RunRecord
+	LastSuccess *RunRecord
+}
+
+// jobDirs lists the per event directories created by pn below dir, indexed by event.
+func jobDirs(dir string) (map[string]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "periodicnoise-*"))
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]string, len(matches))
+	for _, m := range matches {
+		event := strings.TrimPrefix(filepath.Base(m), "periodicnoise-")
+		if fi, err := os.Stat(m); err == nil && fi.IsDir() && event != "" {
+			dirs[event] = m
+		}
+	}
+	return dirs, nil
+}
+
+// lockSlots lists the slots of --max-concurrent, which have a lock file,
+// given filename of slot 1.
+func lockSlots(filename string) []int {
+	var slots []int
+	if _, err := os.Stat(filename); err == nil {
+		slots = append(slots, 1)
+	}
+	prefix := strings.TrimSuffix(filename, ".lock") + "."
+	matches, _ := filepath.Glob(prefix + "*.lock")
+	for _, m := range matches {
+		slot, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(m, prefix), ".lock"))
+		if err == nil && slot > 1 && lockSlotFile(filename, uint(slot)) == m {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// lockEvent returns the monitoring event, which took lock file filename last.
+// Several events may share a lock name, so it falls back to the name only
+// for lock files without event file.
+func lockEvent(filename, name string) string {
+	b, err := ioutil.ReadFile(eventFile(filename))
+	if event := strings.TrimSpace(string(b)); err == nil && event != "" {
+		return event
+	}
+	return name
+}
+
+// jobStatus returns the status of event in jobs, adding it if needed.
+func jobStatus(jobs map[string]*JobStatus, event string) *JobStatus {
+	status, ok := jobs[event]
+	if !ok {
+		status = &JobStatus{Event: event}
+		jobs[event] = status
+	}
+	return status
+}
+
+// lockStatus fills in lock owners and running time from the lock files of all
+// slots of lock name, given filename of slot 1, for the events holding them.
+func lockStatus(jobs map[string]*JobStatus, filename, name string) {
+	locked := false
+	for _, slot := range lockSlots(filename) {
+		slotname := lockSlotFile(filename, uint(slot))
+		fi, err := os.Stat(slotname)
+		if err != nil {
+			continue
+		}
+		lock, err := lockfile.New(slotname)
+		if err != nil {
+			continue
+		}
+		// stale lock files of dead processes don't count
+		process, err := lock.GetOwner()
+		if err != nil {
+			continue
+		}
+		status := jobStatus(jobs, lockEvent(slotname, name))
+		status.Locked = true
+		status.Owners = append(status.Owners, process.Pid)
+		if running := time.Since(fi.ModTime()); running > status.Running {
+			status.Running = running
+		}
+		locked = true
+	}
+	if !locked {
+		jobStatus(jobs, lockEvent(filename, name))
+	}
+}
+
+// historyStatus fills in the last run and last successful run from the history of the event.
+func historyStatus(status *JobStatus, filename string) error {
+	records, err := loadHistory(filename)
+	if err != nil {
+		return err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if status.LastRun == nil {
+			status.LastRun = &records[i]
+		}
+		if records[i].Result == monitorOk.String() {
+			status.LastSuccess = &records[i]
+			break
+		}
+	}
+	return nil
+}
+
+// collectStatus gathers the status of all monitoring events with locks in lockDir
+// or run history in stateDir, sorted by event. Locks and history are joined on
+// the event, even if the lock has another name.
+func collectStatus(lockDir, stateDir string) ([]JobStatus, error) {
+	locks, err := jobDirs(lockDir)
+	if err != nil {
+		return nil, err
+	}
+	histories, err := jobDirs(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	byEvent := make(map[string]*JobStatus, len(locks)+len(histories))
+	for name, dir := range locks {
+		lockStatus(byEvent, filepath.Join(dir, name+".lock"), name)
+	}
+	for event, dir := range histories {
+		filename := filepath.Join(dir, event+".history")
+		// e.g. the directory of a lock named differently than its events
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			continue
+		}
+		// one unreadable history doesn't hide the status of all other events
+		if err := historyStatus(jobStatus(byEvent, event), filename); err != nil {
+			log.Printf("ERROR: reading history of %s: %s\n", event, err)
+		}
+	}
+
+	events := make([]string, 0, len(byEvent))
+	for event := range byEvent {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+
+	jobs := make([]JobStatus, 0, len(events))
+	for _, event := range events {
+		jobs = append(jobs, *byEvent[event])
+	}
+	return jobs, nil
+}
+
+// formatTime shows when rec started, if there is one
+func formatTime(rec *RunRecord) string {
+	if rec == nil {
+		return "-"
+	}
+	return rec.Start.Format(time.RFC3339)
+}
+
+// writeStatus prints jobs as table to w.
+func writeStatus(w io.Writer, jobs []JobStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "EVENT\tLOCKED\tPID\tRUNNING\tLAST RESULT\tLAST RUN\tLAST SUCCESS")
+	for _, job := range jobs {
+		locked, pid, running := "no", "-", "-"
+		if job.Locked {
+			locked = "yes"
+			pids := make([]string, len(job.Owners))
+			for i, owner := range job.Owners {
+				pids[i] = fmt.Sprint(owner)
+			}
+			pid = strings.Join(pids, ",")
+			running = (job.Running / time.Second * time.Second).String()
+		}
+		result := "-"
+		if job.LastRun != nil {
+			result = job.LastRun.Result
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			job.Event, locked, pid, running, result,
+			formatTime(job.LastRun), formatTime(job.LastSuccess))
+	}
+	return tw.Flush()
+}
+
+// runStatus implements "pn status", listing all monitoring events known on this host.
+func runStatus(args []string, w io.Writer) error {
+	p := flags.NewParser(&statusOpts, flags.Default)
+	p.Usage = "status [OPTIONS]\n\nList monitoring events on this host, whether they are running and their last result"
+
+	if _, err := p.ParseArgs(args); err != nil {
+		// --help is not an error
+		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+			return nil
+		}
+		return err
+	}
+
+	stateDir := statusOpts.StateDir
+	if stateDir == "" {
+		stateDir = os.TempDir()
+	}
+
+	if err := loadLockConfig(); err != nil {
+		return err
+	}
+	lockDir := statusOpts.LockDir
+	if lockDir == "" {
+		lockDir = lockConfig.Dir
+	}
+	if lockDir == "" {
+		lockDir = os.TempDir()
+	}
+	// lock files need absolute paths
+	if abs, err := filepath.Abs(lockDir); err == nil {
+		lockDir = abs
+	}
+
+	jobs, err := collectStatus(lockDir, stateDir)
+	if err != nil {
+		return err
+	}
+	return writeStatus(w, jobs)
+}
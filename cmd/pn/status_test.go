@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeJobDir(t *testing.T, dir, event string) string {
+	jobdir := filepath.Join(dir, "periodicnoise-"+event)
+	if err := os.Mkdir(jobdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	return jobdir
+}
+
+func TestCollectStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pnstatus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// running job, locked by us
+	running := makeJobDir(t, dir, "running")
+	lockname := filepath.Join(running, "running.lock")
+	if err := ioutil.WriteFile(lockname, []byte(fmt.Sprintln(os.Getpid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// second and tenth of --max-concurrent slots taken by us, fourth stale
+	for slot, pid := range map[int]int{2: os.Getpid(), 4: 2147483647, 10: os.Getpid()} {
+		slotname := filepath.Join(running, fmt.Sprintf("running.%d.lock", slot))
+		if err := ioutil.WriteFile(slotname, []byte(fmt.Sprintln(pid)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// idle job with history
+	idle := makeJobDir(t, dir, "idle")
+	start := time.Date(2015, 8, 24, 12, 24, 33, 0, time.UTC)
+	for i, result := range []string{"OK", "CRITICAL", "CRITICAL"} {
+		rec := RunRecord{Start: start.Add(time.Duration(i) * time.Hour), Attempts: 1, Result: result}
+		if err := appendHistory(filepath.Join(idle, "idle.history"), rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs, err := collectStatus(dir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("want 2 jobs, got %+v", jobs)
+	}
+
+	if job := jobs[0]; job.Event != "idle" || job.Locked {
+		t.Errorf("want unlocked idle job, got %+v", job)
+	} else if job.LastRun == nil || job.LastRun.Result != "CRITICAL" {
+		t.Errorf("want last result CRITICAL, got %+v", job.LastRun)
+	} else if job.LastSuccess == nil || !job.LastSuccess.Start.Equal(start) {
+		t.Errorf("want last success at %s, got %+v", start, job.LastSuccess)
+	}
+
+	if slots := lockSlots(lockname); fmt.Sprint(slots) != "[1 2 4 10]" {
+		t.Errorf("got slots %v, want [1 2 4 10]", slots)
+	}
+	if job := jobs[1]; job.Event != "running" || !job.Locked || len(job.Owners) != 3 || job.Owners[0] != os.Getpid() {
+		t.Errorf("want running job locked thrice by %d, got %+v", os.Getpid(), job)
+	} else if job.LastRun != nil {
+		t.Errorf("want no history, got %+v", job.LastRun)
+	}
+
+	var out bytes.Buffer
+	if err := writeStatus(&out, jobs); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("\n" + out.String())
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 {
+		t.Errorf("want header and 2 jobs, got %q", out.String())
+	}
+}
+
+func TestRunStatusLockDirFromConfig(t *testing.T) {
+	oldopts, oldConfig, oldGlobal := statusOpts, lockConfig, GlobalConfig
+	defer func() { statusOpts, lockConfig, GlobalConfig = oldopts, oldConfig, oldGlobal }()
+
+	dir, err := ioutil.TempDir("", "pnstatus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lockDir := filepath.Join(dir, "locks")
+	if err := os.Mkdir(lockDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	makeJobDir(t, lockDir, "configured")
+
+	GlobalConfig = filepath.Join(dir, "config.ini")
+	if err := ioutil.WriteFile(GlobalConfig, []byte("[lock]\ndir = "+lockDir+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runStatus([]string{"--state-dir", dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "configured") {
+		t.Errorf("want job below configured lock dir listed, got %q", out.String())
+	}
+}
+
+func TestCollectStatusSharedLockName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pnstatus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// backup_db runs with --lock-name=db and has history of an earlier run
+	db := makeJobDir(t, dir, "db")
+	lockname := filepath.Join(db, "db.lock")
+	if err := ioutil.WriteFile(lockname, []byte(fmt.Sprintln(os.Getpid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(eventFile(lockname), []byte("backup_db\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backup := makeJobDir(t, dir, "backup_db")
+	if err := appendHistory(filepath.Join(backup, "backup_db.history"), RunRecord{Attempts: 1, Result: "OK"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// vacuum_db took the lock named vacuum last, which is free now
+	vacuum := makeJobDir(t, dir, "vacuum")
+	if err := ioutil.WriteFile(eventFile(filepath.Join(vacuum, "vacuum.lock")), []byte("vacuum_db\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := collectStatus(dir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("want 2 jobs, got %+v", jobs)
+	}
+	if job := jobs[0]; job.Event != "backup_db" || !job.Locked || job.LastRun == nil {
+		t.Errorf("want backup_db locked with last run, got %+v", job)
+	}
+	if job := jobs[1]; job.Event != "vacuum_db" || job.Locked {
+		t.Errorf("want unlocked vacuum_db, got %+v", job)
+	}
+}
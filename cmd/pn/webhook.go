@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// webhookRetryDelay is the pause between attempts to deliver to a webhook.
+var webhookRetryDelay = time.Second
+
+// WebhookBackend posts reports as JSON document to an HTTP endpoint.
+type WebhookBackend struct {
+	URL     string
+	Headers map[string]string
+	Timeout time.Duration
+	Retries uint
+}
+
+// webhook is configured in the webhook section of our config
+var webhook = WebhookBackend{
+	Headers: map[string]string{},
+	Timeout: 10 * time.Second,
+}
+
+// Enabled reports whether a webhook URL is configured.
+func (w *WebhookBackend) Enabled() bool {
+	return w.URL != ""
+}
+
+// webhookPayload is the JSON document posted to the webhook.
+type webhookPayload struct {
+	Event    string    `json:"event"`
+	State    string    `json:"state"`
+	Message  string    `json:"message"`
+	Hostname string    `json:"hostname"`
+	Duration float64   `json:"duration_seconds"`
+	ExitCode int       `json:"exit_code"`
+	Attempts uint      `json:"attempts"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+// Notify implements MonitoringBackend.
+// Failed deliveries are retried, as long as they fit before the deadline of the report.
+func (w *WebhookBackend) Notify(r *Report) error {
+	host := r.SendAs
+	if host == "" {
+		host = r.Hostname
+	}
+	body, err := json.Marshal(webhookPayload{
+		Event:    r.Event,
+		State:    r.State.String(),
+		Message:  r.Message,
+		Hostname: host,
+		Duration: r.Duration.Seconds(),
+		ExitCode: r.ExitCode,
+		Attempts: r.Attempt,
+		Start:    r.Start,
+		End:      r.End,
+	})
+	if err != nil {
+		return err
+	}
+
+	for attempt := uint(0); ; attempt++ {
+		err = w.post(body, r.Timeout(w.Timeout))
+		if err == nil || attempt >= w.Retries {
+			return err
+		}
+		if !r.Deadline.IsZero() && !time.Now().Add(webhookRetryDelay).Before(r.Deadline) {
+			return err
+		}
+		time.Sleep(webhookRetryDelay)
+	}
+}
+
+func (w *WebhookBackend) post(body []byte, timeout time.Duration) error {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.Headers {
+		req.Header.Set(name, value)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
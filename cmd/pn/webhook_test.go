@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestWebhookPayload(t *testing.T) {
+	var got webhookPayload
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	start := time.Date(2015, 8, 24, 12, 24, 33, 0, time.UTC)
+	hook := WebhookBackend{
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Timeout: time.Second,
+	}
+	err := hook.Notify(&Report{
+		Event:    "backup_db",
+		State:    monitorCritical,
+		Message:  "disk full",
+		Hostname: "somehost.example.com",
+		Start:    start,
+		End:      start.Add(90 * time.Second),
+		Duration: 90 * time.Second,
+		Attempt:  3,
+		ExitCode: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := webhookPayload{
+		Event:    "backup_db",
+		State:    "CRITICAL",
+		Message:  "disk full",
+		Hostname: "somehost.example.com",
+		Duration: 90,
+		ExitCode: 2,
+		Attempts: 3,
+		Start:    start,
+		End:      start.Add(90 * time.Second),
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if ct := header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got content type %q, want application/json", ct)
+	}
+	if auth := header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("got authorization %q, want configured header", auth)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	oldDelay := webhookRetryDelay
+	defer func() { webhookRetryDelay = oldDelay }()
+	webhookRetryDelay = 10 * time.Millisecond
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	hook := WebhookBackend{URL: server.URL, Timeout: time.Second, Retries: 1}
+	if err := hook.Notify(&Report{Event: "backup_db"}); err == nil {
+		t.Error("want error after exhausting retries, got nil")
+	} else {
+		t.Log("got", err)
+	}
+
+	calls = 0
+	hook.Retries = 5
+	if err := hook.Notify(&Report{Event: "backup_db"}); err != nil {
+		t.Error("want no error, got", err)
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+}
+
+func TestWebhookRetriesWithinDeadline(t *testing.T) {
+	oldDelay := webhookRetryDelay
+	defer func() { webhookRetryDelay = oldDelay }()
+	webhookRetryDelay = 50 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	hook := WebhookBackend{URL: server.URL, Timeout: time.Second, Retries: 100}
+	start := time.Now()
+	deadline := start.Add(200 * time.Millisecond)
+	if err := hook.Notify(&Report{Event: "backup_db", Deadline: deadline}); err == nil {
+		t.Error("want error, got nil")
+	}
+	if took := time.Since(start); took > 300*time.Millisecond {
+		t.Errorf("retries took %s, want them to stop at deadline", took)
+	}
+}
+
+func TestWebhookConfig(t *testing.T) {
+	oldWebhook := webhook
+	defer func() { webhook = oldWebhook }()
+	webhook.Headers = map[string]string{}
+
+	config, err := ini.Load(strings.NewReader(`
+[webhook]
+url                  = https://alerts.example.com/pn
+timeout              = 5s
+retries              = 2
+header.Authorization = Bearer secret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fillWebhook(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if webhook.URL != "https://alerts.example.com/pn" || webhook.Timeout != 5*time.Second || webhook.Retries != 2 {
+		t.Errorf("got %+v", webhook)
+	}
+	if auth := webhook.Headers["Authorization"]; auth != "Bearer secret" {
+		t.Errorf("got authorization %q, want configured header", auth)
+	}
+}
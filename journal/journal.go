@@ -0,0 +1,142 @@
+// +build linux
+
+// Package journal sends messages to the systemd journal using its
+// native protocol, see http://www.freedesktop.org/wiki/Software/systemd/export/
+//
+// Other than via syslog, each message can carry fields of its own,
+// which can be queried with e.g. journalctl FIELD=value.
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SocketPath is where journald receives messages.
+const SocketPath = "/run/systemd/journal/socket"
+
+// Priority is the severity of a message, as used by syslog.
+type Priority int
+
+const (
+	PriEmerg Priority = iota
+	PriAlert
+	PriCrit
+	PriErr
+	PriWarning
+	PriNotice
+	PriInfo
+	PriDebug
+)
+
+// Conn is a connection to journald.
+type Conn struct {
+	conn *net.UnixConn
+}
+
+// Dial connects to journald listening at path, SocketPath if empty.
+func Dial(path string) (*Conn, error) {
+	if path == "" {
+		path = SocketPath
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn}, nil
+}
+
+// Close closes the connection to journald.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Send sends message with priority and additional fields, e.g. SYSLOG_IDENTIFIER.
+// Field names are converted to upper case and invalid characters replaced by "_".
+func (c *Conn) Send(message string, priority Priority, fields map[string]string) error {
+	var buf bytes.Buffer
+	appendField(&buf, "MESSAGE", message)
+	appendField(&buf, "PRIORITY", strconv.Itoa(int(priority)))
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		appendField(&buf, fieldName(name), fields[name])
+	}
+
+	_, err := c.conn.Write(buf.Bytes())
+	if isTooLarge(err) {
+		return c.sendFile(buf.Bytes())
+	}
+	return err
+}
+
+// appendField encodes a field, values with newlines need to carry their length.
+func appendField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if strings.ContainsRune(value, '\n') {
+		buf.WriteByte('\n')
+		binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	} else {
+		buf.WriteByte('=')
+	}
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// fieldName converts name to a valid field name, consisting of
+// upper case letters, digits and underscores, not starting with an underscore.
+func fieldName(name string) string {
+	b := []byte(strings.ToUpper(name))
+	for i, c := range b {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	return string(bytes.TrimLeft(b, "_"))
+}
+
+func isTooLarge(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.EMSGSIZE || err == syscall.ENOBUFS
+}
+
+// sendFile passes messages too large for a datagram as file descriptor of
+// a deleted temporary file.
+func (c *Conn) sendFile(msg []byte) error {
+	f, err := ioutil.TempFile("/dev/shm", "journal")
+	if err != nil {
+		f, err = ioutil.TempFile("", "journal")
+		if err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+
+	if _, err := f.Write(msg); err != nil {
+		return err
+	}
+	// the connected socket can only pass file descriptors via sendmsg
+	sock, err := c.conn.File()
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+	return syscall.Sendmsg(int(sock.Fd()), nil, syscall.UnixRights(int(f.Fd())), nil, 0)
+}
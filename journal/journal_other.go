@@ -0,0 +1,45 @@
+// +build !linux
+
+// Package journal sends messages to the systemd journal using its
+// native protocol. It is only implemented on Linux.
+package journal
+
+import "errors"
+
+// SocketPath is where journald receives messages.
+const SocketPath = "/run/systemd/journal/socket"
+
+// Priority is the severity of a message, as used by syslog.
+type Priority int
+
+const (
+	PriEmerg Priority = iota
+	PriAlert
+	PriCrit
+	PriErr
+	PriWarning
+	PriNotice
+	PriInfo
+	PriDebug
+)
+
+// ErrUnsupported is returned by Dial, where there is no systemd.
+var ErrUnsupported = errors.New("journal: only supported on Linux")
+
+// Conn is a connection to journald.
+type Conn struct{}
+
+// Dial fails with ErrUnsupported.
+func Dial(path string) (*Conn, error) {
+	return nil, ErrUnsupported
+}
+
+// Close does nothing.
+func (c *Conn) Close() error {
+	return nil
+}
+
+// Send fails with ErrUnsupported.
+func (c *Conn) Send(message string, priority Priority, fields map[string]string) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,154 @@
+// +build linux
+
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listen starts a fake journald, returning its socket path.
+func listen(t *testing.T) (string, *net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "journaltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "socket")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, l, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// receive reads the next message, following passed file descriptors.
+func receive(t *testing.T, l *net.UnixConn) map[string]string {
+	buf := make([]byte, 1<<16)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, oobn, _, _, err := l.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf[:n]
+
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := os.NewFile(uintptr(fds[0]), "passed")
+		defer f.Close()
+		f.Seek(0, 0)
+		if data, err = ioutil.ReadAll(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return parse(t, data)
+}
+
+// parse decodes the fields of a message in the native protocol.
+func parse(t *testing.T, data []byte) map[string]string {
+	fields := map[string]string{}
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return fields
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if i := strings.Index(line, "="); i >= 0 {
+			fields[line[:i]] = line[i+1:]
+			continue
+		}
+		var size uint64
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			t.Fatal(err)
+		}
+		value := make([]byte, size+1)
+		if _, err := io.ReadFull(r, value); err != nil {
+			t.Fatal(err)
+		}
+		fields[line] = string(value[:size])
+	}
+}
+
+func TestSend(t *testing.T) {
+	path, l, cleanup := listen(t)
+	defer cleanup()
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Send("first line\nsecond line", PriErr, map[string]string{
+		"SYSLOG_IDENTIFIER": "backup_db",
+		"pn_event":          "backup_db",
+		"_PID":              "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := receive(t, l)
+	want := map[string]string{
+		"MESSAGE":           "first line\nsecond line",
+		"PRIORITY":          "3",
+		"SYSLOG_IDENTIFIER": "backup_db",
+		"PN_EVENT":          "backup_db",
+		// trusted fields can't be faked
+		"PID": "1",
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s: got %q, want %q", name, got[name], value)
+		}
+	}
+}
+
+func TestSendLarge(t *testing.T) {
+	path, l, cleanup := listen(t)
+	defer cleanup()
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	large := strings.Repeat("x", 1<<20)
+	if err := c.Send(large, PriInfo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, l); got["MESSAGE"] != large {
+		t.Errorf("got message of %d bytes, want %d", len(got["MESSAGE"]), len(large))
+	}
+}
+
+func TestDialMissing(t *testing.T) {
+	if _, err := Dial("/nonexistent/journal/socket"); err == nil {
+		t.Error("want error, got nil")
+	}
+}
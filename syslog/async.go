@@ -0,0 +1,235 @@
+// +build !windows,!plan9
+
+package syslog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// drainTimeout limits how long Close waits for queued messages to be delivered.
+var drainTimeout = 1 * time.Second
+
+// maxSpoolSize limits the size of spool files in bytes.
+var maxSpoolSize int64 = 10 << 20
+
+// record is a message waiting for delivery, one per line in spool files.
+type record struct {
+	Time     time.Time `json:"time"`
+	Priority Priority  `json:"priority"`
+	MsgID    string    `json:"msgid,omitempty"`
+	Data     string    `json:"data,omitempty"`
+	Msg      string    `json:"msg"`
+}
+
+// An AsyncWriter queues messages for a Writer, so logging never blocks
+// on a slow or unreachable syslog daemon.
+//
+// Messages not fitting into the queue, not deliverable or still queued
+// on Close are appended to the spool file, if any. Close doesn't wait
+// for a hanging delivery longer than drainTimeout. Once a message has
+// been spooled, all further ones are spooled as well to keep them in order.
+// The next AsyncWriter using the same spool file delivers them first.
+type AsyncWriter struct {
+	w     *Writer
+	spool string
+	queue chan record
+	done  chan struct{}
+
+	mu        sync.Mutex // guards fields below and the spool file
+	closed    bool
+	drainBy   time.Time
+	spooled   bool
+	dropped   int
+	inflight  *record // being delivered by run
+	abandoned bool    // Close gave up waiting for run
+}
+
+// NewAsync starts delivering messages to w in the background, queueing
+// up to size messages. An empty spool drops messages instead of spooling them.
+func NewAsync(w *Writer, size int, spool string) *AsyncWriter {
+	a := &AsyncWriter{
+		w:     w,
+		spool: spool,
+		queue: make(chan record, size),
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Write queues a log message for the syslog daemon. It never blocks.
+func (a *AsyncWriter) Write(b []byte) (int, error) {
+	return a.send(time.Now(), a.w.priority, "", "", string(b))
+}
+
+// Structured returns a writer queueing messages like Writer.Structured.
+func (a *AsyncWriter) Structured(p Priority, msgID string, data ...SDElement) *StructuredWriter {
+	sw := a.w.Structured(p, msgID, data...)
+	sw.w = a
+	return sw
+}
+
+// Close delivers the queued messages, spooling the ones left after
+// drainTimeout, and closes the connection to the syslog daemon.
+// It reports messages, which have been dropped.
+func (a *AsyncWriter) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.drainBy = time.Now().Add(drainTimeout)
+	close(a.queue)
+	a.mu.Unlock()
+
+	var err error
+	select {
+	case <-a.done:
+		err = a.w.Close()
+	case <-time.After(drainTimeout + writeTimeout):
+		// the daemon hangs, keep what is left for later
+		a.mu.Lock()
+		a.abandoned = true
+		if a.inflight != nil {
+			a.spoolLocked(*a.inflight)
+		}
+		for r := range a.queue {
+			a.spoolLocked(r)
+		}
+		a.mu.Unlock()
+
+		// the hanging delivery holds the Writer, so don't wait for it
+		go a.w.Close()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.dropped > 0 {
+		return fmt.Errorf("log/syslog: dropped %d messages", a.dropped)
+	}
+	return err
+}
+
+func (a *AsyncWriter) send(t time.Time, p Priority, msgID, data, s string) (int, error) {
+	r := record{Time: t, Priority: p, MsgID: msgID, Data: data, Msg: s}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return 0, errors.New("log/syslog: write to closed AsyncWriter")
+	}
+	select {
+	case a.queue <- r:
+	default:
+		a.spoolLocked(r)
+	}
+	return len(s), nil
+}
+
+// run delivers spooled and queued messages until the queue is closed.
+func (a *AsyncWriter) run() {
+	defer close(a.done)
+
+	a.flushSpool()
+	for r := range a.queue {
+		a.mu.Lock()
+		late := !a.drainBy.IsZero() && time.Now().After(a.drainBy)
+		if late || a.spooled {
+			a.spoolLocked(r)
+			a.mu.Unlock()
+			continue
+		}
+		a.inflight = &r
+		a.mu.Unlock()
+
+		_, err := a.w.send(r.Time, r.Priority, r.MsgID, r.Data, r.Msg)
+
+		a.mu.Lock()
+		a.inflight = nil
+		// after Close gave up, it has taken care of r already
+		if err != nil && !a.abandoned {
+			a.spoolLocked(r)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// flushSpool delivers messages spooled by earlier writers.
+// The ones not deliverable are spooled again.
+func (a *AsyncWriter) flushSpool() {
+	if a.spool == "" {
+		return
+	}
+	// overlapping runs flush the same spool, so each renames it to a name of its own
+	flushing := fmt.Sprintf("%s.flushing.%d", a.spool, os.Getpid())
+	if err := os.Rename(a.spool, flushing); err != nil {
+		return
+	}
+	defer os.Remove(flushing)
+
+	f, err := os.Open(flushing)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var rest []record
+	dec := json.NewDecoder(f)
+	for {
+		var r record
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			// the spool is corrupted, e.g. by a full disk
+			a.mu.Lock()
+			a.dropped++
+			a.mu.Unlock()
+			break
+		}
+		if len(rest) == 0 {
+			if _, err := a.w.send(r.Time, r.Priority, r.MsgID, r.Data, r.Msg); err == nil {
+				continue
+			}
+		}
+		rest = append(rest, r)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range rest {
+		a.spoolLocked(r)
+	}
+}
+
+// spoolLocked appends r to the spool file, or drops it.
+// It must be called with a.mu held.
+func (a *AsyncWriter) spoolLocked(r record) {
+	if a.spool == "" {
+		a.dropped++
+		return
+	}
+	a.spooled = true
+
+	f, err := os.OpenFile(a.spool, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		a.dropped++
+		return
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil || fi.Size() >= maxSpoolSize {
+		a.dropped++
+		return
+	}
+	if err := json.NewEncoder(f).Encode(r); err != nil {
+		a.dropped++
+	}
+}
@@ -0,0 +1,246 @@
+// +build !windows,!plan9
+
+package syslog
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAsyncWriter(t *testing.T) {
+	done := make(chan string)
+	addr, sock, _ := startServer("udp", "", done)
+	defer sock.Close()
+
+	w, err := Dial("udp", addr, LOG_USER|LOG_INFO, "syslog_test")
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	a := NewAsync(w, 10, "")
+	for _, msg := range []string{"first", "second", "third"} {
+		if _, err := io.WriteString(a, msg); err != nil {
+			t.Fatalf("WriteString() failed: %v", err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	rcvd := <-done
+	for _, msg := range []string{"first", "second", "third"} {
+		if !strings.Contains(rcvd, "]: "+msg+"\n") {
+			t.Errorf("got %q, want message %q", rcvd, msg)
+		}
+	}
+
+	if _, err := io.WriteString(a, "late"); err == nil {
+		t.Error("want error writing after Close")
+	}
+}
+
+func TestAsyncWriterSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syslogtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "log")
+	spool := filepath.Join(dir, "spool")
+
+	done := make(chan string)
+	_, sock, _ := startServer("unixgram", addr, done)
+	w, err := Dial("unixgram", addr, LOG_USER|LOG_INFO, "syslog_test")
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	// the daemon is gone
+	sock.Close()
+	<-done
+	os.Remove(addr)
+
+	a := NewAsync(w, 10, spool)
+	sw := a.Structured(LOG_ERR, "stderr", SDElement{ID: "test@32473"})
+	for _, msg := range []string{"first", "second"} {
+		if _, err := io.WriteString(sw, msg); err != nil {
+			t.Fatalf("WriteString() failed: %v", err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if fi, err := os.Stat(spool); err != nil || fi.Size() == 0 {
+		t.Fatalf("want spooled messages, got %v", err)
+	}
+
+	// the daemon is back, so the next writer delivers the spool
+	_, sock, _ = startServer("unixgram", addr, done)
+	defer sock.Close()
+	w, err = Dial("unixgram", addr, LOG_USER|LOG_INFO, "syslog_test")
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	w.SetFormat(FormatRFC5424)
+	a = NewAsync(w, 10, spool)
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	rcvd := <-done
+	for _, msg := range []string{"first", "second"} {
+		if !strings.Contains(rcvd, " stderr [test@32473] "+msg+"\n") {
+			t.Errorf("got %q, want message %q", rcvd, msg)
+		}
+	}
+	if !strings.HasPrefix(rcvd, "<11>1 ") {
+		t.Errorf("got %q, want spooled priority", rcvd)
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("want spool removed after delivery, got %v", err)
+	}
+}
+
+func TestAsyncWriterDropped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syslogtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "log")
+
+	done := make(chan string)
+	_, sock, _ := startServer("unixgram", addr, done)
+	w, err := Dial("unixgram", addr, LOG_USER|LOG_INFO, "syslog_test")
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	sock.Close()
+	<-done
+	os.Remove(addr)
+
+	a := NewAsync(w, 10, "")
+	io.WriteString(a, "lost")
+	if err := a.Close(); err == nil {
+		t.Error("want error about dropped messages, got nil")
+	} else {
+		t.Log("got", err)
+	}
+}
+
+// hangingConn is a connection to a syslog daemon, which never accepts a message.
+type hangingConn struct {
+	release chan struct{}
+}
+
+func (c *hangingConn) writeString(h *header, s, nl string) error {
+	<-c.release
+	return errors.New("released")
+}
+
+func (c *hangingConn) close() error                       { return nil }
+func (c *hangingConn) setWriteDeadline(t time.Time) error { return nil }
+
+func TestAsyncWriterHangingDaemon(t *testing.T) {
+	oldDrain, oldWrite := drainTimeout, writeTimeout
+	defer func() { drainTimeout, writeTimeout = oldDrain, oldWrite }()
+	drainTimeout, writeTimeout = 50*time.Millisecond, 50*time.Millisecond
+
+	dir, err := ioutil.TempDir("", "syslogtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool := filepath.Join(dir, "spool")
+
+	conn := &hangingConn{release: make(chan struct{})}
+	w := &Writer{priority: LOG_USER | LOG_INFO, tag: "syslog_test", conn: conn}
+
+	a := NewAsync(w, 10, spool)
+	defer func() {
+		// let the abandoned delivery finish before restoring the timeouts
+		close(conn.release)
+		<-a.done
+	}()
+	for _, msg := range []string{"first", "second"} {
+		io.WriteString(a, msg)
+	}
+
+	start := time.Now()
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Close took %s, want it not to wait for the hanging daemon", took)
+	}
+
+	spooled, err := ioutil.ReadFile(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{`"msg":"first"`, `"msg":"second"`} {
+		if !strings.Contains(string(spooled), msg) {
+			t.Errorf("got spool %q, want message %s, which was being delivered or queued", spooled, msg)
+		}
+	}
+	if strings.Index(string(spooled), "first") > strings.Index(string(spooled), "second") {
+		t.Errorf("got spool %q, want messages in order", spooled)
+	}
+}
+
+// recordingConn is a connection to a syslog daemon, which records the messages.
+type recordingConn struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (c *recordingConn) writeString(h *header, s, nl string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, s)
+	return nil
+}
+
+func (c *recordingConn) close() error                       { return nil }
+func (c *recordingConn) setWriteDeadline(t time.Time) error { return nil }
+
+func TestAsyncWriterFlushesOwnSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syslogtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool := filepath.Join(dir, "spool")
+
+	b, err := json.Marshal(record{Time: time.Now(), Priority: LOG_USER | LOG_INFO, Msg: "spooled"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(spool, append(b, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// another run is flushing what it took from the spool before
+	other := spool + ".flushing.1"
+	if err := ioutil.WriteFile(other, append(b, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &recordingConn{}
+	w := &Writer{priority: LOG_USER | LOG_INFO, tag: "syslog_test", conn: conn}
+	if err := NewAsync(w, 10, spool).Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	if len(conn.msgs) != 1 || conn.msgs[0] != "spooled" {
+		t.Errorf("got %q, want spooled message delivered", conn.msgs)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("want spool flushed by other run kept, got %v", err)
+	}
+}
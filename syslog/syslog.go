@@ -6,7 +6,7 @@
 
 // Package syslog provides a simple interface to the system log
 // service. It can send messages to the syslog daemon using UNIX
-// domain sockets, UDP or TCP.
+// domain sockets, UDP, TCP or TLS.
 //
 // Only one call to Dial is necessary. On write failures,
 // the syslog client will attempt to reconnect to the server
@@ -14,11 +14,14 @@
 package syslog
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -82,13 +85,116 @@ const (
 	LOG_LOCAL7
 )
 
+var severityNames = map[string]Priority{
+	"emerg":   LOG_EMERG,
+	"alert":   LOG_ALERT,
+	"crit":    LOG_CRIT,
+	"err":     LOG_ERR,
+	"error":   LOG_ERR,
+	"warning": LOG_WARNING,
+	"warn":    LOG_WARNING,
+	"notice":  LOG_NOTICE,
+	"info":    LOG_INFO,
+	"debug":   LOG_DEBUG,
+}
+
+var facilityNames = map[string]Priority{
+	"kern":     LOG_KERN,
+	"user":     LOG_USER,
+	"mail":     LOG_MAIL,
+	"daemon":   LOG_DAEMON,
+	"auth":     LOG_AUTH,
+	"syslog":   LOG_SYSLOG,
+	"lpr":      LOG_LPR,
+	"news":     LOG_NEWS,
+	"uucp":     LOG_UUCP,
+	"cron":     LOG_CRON,
+	"authpriv": LOG_AUTHPRIV,
+	"ftp":      LOG_FTP,
+	"local0":   LOG_LOCAL0,
+	"local1":   LOG_LOCAL1,
+	"local2":   LOG_LOCAL2,
+	"local3":   LOG_LOCAL3,
+	"local4":   LOG_LOCAL4,
+	"local5":   LOG_LOCAL5,
+	"local6":   LOG_LOCAL6,
+	"local7":   LOG_LOCAL7,
+}
+
+// ParseSeverity parses the name of a severity as used by syslog.conf, e.g. "warning".
+func ParseSeverity(s string) (Priority, error) {
+	if p, ok := severityNames[strings.ToLower(s)]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("log/syslog: unknown severity %q", s)
+}
+
+// ParseFacility parses the name of a facility as used by syslog.conf, e.g. "local0".
+func ParseFacility(s string) (Priority, error) {
+	if p, ok := facilityNames[strings.ToLower(s)]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("log/syslog: unknown facility %q", s)
+}
+
+// A Format selects the layout of the messages sent by a Writer.
+type Format int
+
+const (
+	// FormatBSD is the traditional format
+	// <PRI>TIMESTAMP HOSTNAME TAG[PID]: MSG
+	FormatBSD Format = iota
+
+	// FormatRFC5424 is the format of RFC 5424
+	// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	FormatRFC5424
+)
+
+// ParseFormat parses the name of a format, either "bsd" or "rfc5424".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "bsd", "rfc3164":
+		return FormatBSD, nil
+	case "rfc5424":
+		return FormatRFC5424, nil
+	}
+	return FormatBSD, fmt.Errorf("log/syslog: unknown format %q, want bsd or rfc5424", s)
+}
+
+// A Framing selects how messages are delimited on stream connections
+// like TCP, see RFC 6587. Datagrams always carry a single message.
+type Framing int
+
+const (
+	// FramingNewline ends each message with a newline, so messages
+	// with embedded newlines break apart at the receiver.
+	FramingNewline Framing = iota
+
+	// FramingOctetCounting prefixes each message with its length.
+	FramingOctetCounting
+)
+
+// ParseFraming parses the name of a framing, either "newline" or "octet-counting".
+func ParseFraming(s string) (Framing, error) {
+	switch strings.ToLower(s) {
+	case "newline", "non-transparent":
+		return FramingNewline, nil
+	case "octet-counting":
+		return FramingOctetCounting, nil
+	}
+	return FramingNewline, fmt.Errorf("log/syslog: unknown framing %q, want newline or octet-counting", s)
+}
+
 // A Writer is a connection to a syslog server.
 type Writer struct {
-	priority Priority
-	tag      string
-	hostname string
-	network  string
-	raddr    string
+	priority  Priority
+	tag       string
+	hostname  string
+	network   string
+	raddr     string
+	format    Format
+	framing   Framing
+	tlsConfig *tls.Config
 
 	mu   sync.Mutex // guards conn
 	conn serverConn
@@ -101,14 +207,27 @@ type Writer struct {
 // return a type that satisfies this interface and simply calls the C
 // library syslog function.
 type serverConn interface {
-	writeString(p Priority, hostname, tag, s, nl string) error
+	writeString(h *header, s, nl string) error
 	close() error
 	setWriteDeadline(t time.Time) error
 }
 
+// header describes a message apart from its text.
+type header struct {
+	time     time.Time
+	format   Format
+	priority Priority
+	hostname string
+	tag      string
+	msgID    string // RFC 5424 only
+	data     string // formatted STRUCTURED-DATA, RFC 5424 only
+	framing  Framing
+}
+
 type netConn struct {
-	local bool
-	conn  net.Conn
+	local  bool
+	stream bool // messages need framing
+	conn   net.Conn
 }
 
 // New establishes a new connection to the system log daemon.  Each
@@ -121,8 +240,30 @@ func New(priority Priority, tag string) (w *Writer, err error) {
 // Dial establishes a connection to a log daemon by connecting to
 // address raddr on the network net.  Each write to the returned
 // writer sends a log message with the given facility, severity and
-// tag.
+// tag. Network "tcp+tls" connects via TLS as described in RFC 5425.
 func Dial(network, raddr string, priority Priority, tag string) (*Writer, error) {
+	return dial(network, raddr, nil, priority, tag)
+}
+
+// DialTLS establishes a connection to a log daemon via TLS like Dial with
+// network "tcp+tls", using config e.g. for CA and client certificates.
+func DialTLS(raddr string, config *tls.Config, priority Priority, tag string) (*Writer, error) {
+	return dial(networkTLS, raddr, config, priority, tag)
+}
+
+// networkTLS is TCP with TLS as described in RFC 5425
+const networkTLS = "tcp+tls"
+
+// isStream reports whether messages sent over network need framing.
+func isStream(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix", networkTLS:
+		return true
+	}
+	return false
+}
+
+func dial(network, raddr string, config *tls.Config, priority Priority, tag string) (*Writer, error) {
 	if priority < 0 || priority > LOG_LOCAL7|LOG_DEBUG {
 		return nil, errors.New("log/syslog: invalid priority")
 	}
@@ -133,11 +274,16 @@ func Dial(network, raddr string, priority Priority, tag string) (*Writer, error)
 	hostname, _ := os.Hostname()
 
 	w := &Writer{
-		priority: priority,
-		tag:      tag,
-		hostname: hostname,
-		network:  network,
-		raddr:    raddr,
+		priority:  priority,
+		tag:       tag,
+		hostname:  hostname,
+		network:   network,
+		raddr:     raddr,
+		tlsConfig: config,
+	}
+	if network == networkTLS {
+		// required by RFC 5425
+		w.framing = FramingOctetCounting
 	}
 
 	w.mu.Lock()
@@ -164,11 +310,21 @@ func (w *Writer) connect() (err error) {
 		if w.hostname == "" {
 			w.hostname = "localhost"
 		}
+	} else if w.network == networkTLS {
+		var c net.Conn
+		dialer := &net.Dialer{Timeout: connectTimeout}
+		c, err = tls.DialWithDialer(dialer, "tcp", w.raddr, w.tlsConfig)
+		if err == nil {
+			w.conn = &netConn{conn: c, stream: true}
+			if w.hostname == "" {
+				w.hostname = c.LocalAddr().String()
+			}
+		}
 	} else {
 		var c net.Conn
-		c, err = net.Dial(w.network, w.raddr)
+		c, err = net.DialTimeout(w.network, w.raddr, connectTimeout)
 		if err == nil {
-			w.conn = &netConn{conn: c}
+			w.conn = &netConn{conn: c, stream: isStream(w.network)}
 			if w.hostname == "" {
 				w.hostname = c.LocalAddr().String()
 			}
@@ -177,11 +333,88 @@ func (w *Writer) connect() (err error) {
 	return
 }
 
+// SetFormat selects the format of all following messages.
+func (w *Writer) SetFormat(f Format) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.format = f
+}
+
+// SetFraming selects how all following messages are delimited
+// on stream connections. Messages with embedded newlines need
+// FramingOctetCounting, if the receiver supports it.
+func (w *Writer) SetFraming(f Framing) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.framing = f
+}
+
 // Write sends a log message to the syslog daemon.
 func (w *Writer) Write(b []byte) (int, error) {
 	return w.writeAndRetry(w.priority, string(b))
 }
 
+// An SDParam is a parameter of an SDElement.
+type SDParam struct {
+	Name, Value string
+}
+
+// An SDElement is an element of RFC 5424 STRUCTURED-DATA,
+// e.g. [exampleSDID@32473 iut="3" eventSource="Application"]
+type SDElement struct {
+	ID     string
+	Params []SDParam
+}
+
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// String formats e as STRUCTURED-DATA element, escaping parameter values.
+func (e SDElement) String() string {
+	s := "[" + sdName(e.ID)
+	for _, p := range e.Params {
+		s += " " + sdName(p.Name) + `="` + sdEscaper.Replace(p.Value) + `"`
+	}
+	return s + "]"
+}
+
+// sdName drops characters not allowed in SD-NAMEs and limits them to 32 characters.
+func sdName(s string) string {
+	name := make([]byte, 0, len(s))
+	for i := 0; i < len(s) && len(name) < 32; i++ {
+		switch c := s[i]; {
+		case c <= ' ' || c >= 127 || c == '=' || c == ']' || c == '"':
+		default:
+			name = append(name, c)
+		}
+	}
+	return string(name)
+}
+
+// A StructuredWriter sends messages with fixed severity, MSGID and
+// STRUCTURED-DATA through the connection of a Writer.
+type StructuredWriter struct {
+	w        sender
+	priority Priority
+	msgID    string
+	data     string
+}
+
+// Structured returns a writer sending each write as message with severity p,
+// msgID and data, sharing the connection of w. MSGID and STRUCTURED-DATA
+// are only sent in FormatRFC5424.
+func (w *Writer) Structured(p Priority, msgID string, data ...SDElement) *StructuredWriter {
+	var sd string
+	for _, e := range data {
+		sd += e.String()
+	}
+	return &StructuredWriter{w: w, priority: p, msgID: msgID, data: sd}
+}
+
+// Write sends a log message to the syslog daemon.
+func (s *StructuredWriter) Write(b []byte) (int, error) {
+	return s.w.send(time.Now(), s.priority, s.msgID, s.data, string(b))
+}
+
 // Close closes a connection to the syslog daemon.
 func (w *Writer) Close() error {
 	w.mu.Lock()
@@ -252,25 +485,47 @@ func (w *Writer) Debug(m string) (err error) {
 }
 
 func (w *Writer) writeAndRetry(p Priority, s string) (int, error) {
+	return w.send(time.Now(), p, "", "", s)
+}
+
+// sender delivers messages logged at time t, either directly or asynchronously.
+type sender interface {
+	send(t time.Time, p Priority, msgID, data, s string) (int, error)
+}
+
+func (w *Writer) send(t time.Time, p Priority, msgID, data, s string) (int, error) {
 	pr := (w.priority & facilityMask) | (p & severityMask)
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	h := &header{
+		time:     t,
+		format:   w.format,
+		priority: pr,
+		hostname: w.hostname,
+		tag:      w.tag,
+		msgID:    msgID,
+		data:     data,
+		framing:  w.framing,
+	}
 	if w.conn != nil {
-		if n, err := w.write(pr, s); err == nil {
+		if n, err := w.write(h, s); err == nil {
 			return n, err
 		}
 	}
 	if err := w.connect(); err != nil {
 		return 0, err
 	}
-	return w.write(pr, s)
+	h.hostname = w.hostname
+	return w.write(h, s)
 }
 
 // write generates and writes a syslog formatted string. The
 // format is as follows: <PRI>TIMESTAMP HOSTNAME TAG[PID]: MSG
-func (w *Writer) write(p Priority, msg string) (int, error) {
+// or in FormatRFC5424:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func (w *Writer) write(h *header, msg string) (int, error) {
 	// ensure it ends in a \n
 	nl := ""
 	if !strings.HasSuffix(msg, "\n") {
@@ -281,7 +536,7 @@ func (w *Writer) write(p Priority, msg string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	err = w.conn.writeString(p, w.hostname, w.tag, msg, nl)
+	err = w.conn.writeString(h, msg, nl)
 	if err != nil {
 		return 0, err
 	}
@@ -291,22 +546,64 @@ func (w *Writer) write(p Priority, msg string) (int, error) {
 	return len(msg), nil
 }
 
-func (n *netConn) writeString(p Priority, hostname, tag, msg, nl string) error {
+// rfc5424Field returns s as header field of at most max printable
+// characters, or the NILVALUE for empty fields.
+func rfc5424Field(s string, max int) string {
+	field := make([]byte, 0, len(s))
+	for i := 0; i < len(s) && len(field) < max; i++ {
+		if c := s[i]; c > ' ' && c < 127 {
+			field = append(field, c)
+		} else {
+			field = append(field, '_')
+		}
+	}
+	if len(field) == 0 {
+		return "-"
+	}
+	return string(field)
+}
+
+func (n *netConn) writeString(h *header, msg, nl string) error {
+	octetCounting := n.stream && h.framing == FramingOctetCounting
+	if octetCounting {
+		// the length marks the end of the message, not the newline
+		nl = ""
+	}
+	m := n.format(h, msg, nl)
+	if octetCounting {
+		m = strconv.Itoa(len(m)) + " " + m
+	}
+	_, err := io.WriteString(n.conn, m)
+	return err
+}
+
+// format returns the message as sent over the connection.
+func (n *netConn) format(h *header, msg, nl string) string {
+	p, hostname, tag := h.priority, h.hostname, h.tag
+	if h.format == FormatRFC5424 {
+		timestamp := h.time.Format("2006-01-02T15:04:05.000000Z07:00")
+		data := h.data
+		if data == "" {
+			data = "-"
+		}
+		return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s%s",
+			p, timestamp, rfc5424Field(hostname, 255),
+			rfc5424Field(tag, 48), os.Getpid(), rfc5424Field(h.msgID, 32),
+			data, msg, nl)
+	}
 	if n.local {
 		// Compared to the network form below, the changes are:
 		//	1. Use time.Stamp instead of time.RFC3339.
 		//	2. Drop the hostname field from the Fprintf.
-		timestamp := time.Now().Format(time.Stamp)
-		_, err := fmt.Fprintf(n.conn, "<%d>%s %s[%d]: %s%s",
+		timestamp := h.time.Format(time.Stamp)
+		return fmt.Sprintf("<%d>%s %s[%d]: %s%s",
 			p, timestamp,
 			tag, os.Getpid(), msg, nl)
-		return err
 	}
-	timestamp := time.Now().Format(time.RFC3339)
-	_, err := fmt.Fprintf(n.conn, "<%d>%s %s %s[%d]: %s%s",
+	timestamp := h.time.Format(time.RFC3339)
+	return fmt.Sprintf("<%d>%s %s %s[%d]: %s%s",
 		p, timestamp, hostname,
 		tag, os.Getpid(), msg, nl)
-	return err
 }
 
 func (n *netConn) close() error {
@@ -8,10 +8,17 @@ package syslog
 
 import (
 	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"os"
 	"strings"
@@ -413,3 +420,255 @@ func TestConcurrentReconnect(t *testing.T) {
 		t.Error("timeout in concurrent reconnect")
 	}
 }
+
+func TestWriteRFC5424(t *testing.T) {
+	done := make(chan string)
+	addr, sock, _ := startServer("udp", "", done)
+	defer sock.Close()
+
+	w, err := Dial("udp", addr, LOG_USER|LOG_NOTICE, "syslog test")
+	if err != nil {
+		t.Fatalf("syslog.Dial() failed: %v", err)
+	}
+	defer w.Close()
+	w.SetFormat(FormatRFC5424)
+
+	sw := w.Structured(LOG_ERR, "stderr", SDElement{
+		ID:     "test@32473",
+		Params: []SDParam{{"event", "backup"}, {"quote", `say "hi" [\]`}},
+	})
+	if _, err := io.WriteString(sw, "write test"); err != nil {
+		t.Fatalf("WriteString() failed: %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	want := fmt.Sprintf(`<%d>1 %%s %s syslog_test %d stderr [test@32473 event="backup" quote="say \"hi\" [\\\]"] write test`+"\n",
+		LOG_USER|LOG_ERR, hostname, os.Getpid())
+	var timestamp string
+	rcvd := <-done
+	if n, err := fmt.Sscanf(rcvd, want, &timestamp); n != 1 || err != nil {
+		t.Errorf("got %q, does not match %q (%d %s)", rcvd, want, n, err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, timestamp); err != nil {
+		t.Errorf("bad timestamp %q: %v", timestamp, err)
+	}
+}
+
+func TestWriteRFC5424NilValues(t *testing.T) {
+	done := make(chan string)
+	addr, sock, _ := startServer("udp", "", done)
+	defer sock.Close()
+
+	w, err := Dial("udp", addr, LOG_USER|LOG_NOTICE, "syslog_test")
+	if err != nil {
+		t.Fatalf("syslog.Dial() failed: %v", err)
+	}
+	defer w.Close()
+	w.SetFormat(FormatRFC5424)
+
+	if _, err := io.WriteString(w, "write test"); err != nil {
+		t.Fatalf("WriteString() failed: %v", err)
+	}
+
+	rcvd := <-done
+	if want := fmt.Sprintf(" syslog_test %d - - write test\n", os.Getpid()); !strings.HasSuffix(rcvd, want) {
+		t.Errorf("got %q, want suffix %q", rcvd, want)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for s, want := range map[string]Format{"bsd": FormatBSD, "RFC5424": FormatRFC5424} {
+		if got, err := ParseFormat(s); err != nil || got != want {
+			t.Errorf("ParseFormat(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseFormat("json"); err == nil {
+		t.Error("want error for unknown format")
+	}
+}
+
+// testCertificate creates a self-signed certificate for 127.0.0.1,
+// usable by both server and client.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "syslog_test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// runOctetCountedSyslog receives octet-counted messages from each connection accepted on l.
+func runOctetCountedSyslog(l net.Listener, done chan<- string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			r := bufio.NewReader(c)
+			for {
+				var n int
+				if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+					return
+				}
+				msg := make([]byte, n)
+				if _, err := io.ReadFull(r, msg); err != nil {
+					return
+				}
+				done <- string(msg)
+			}
+		}(c)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan string)
+	go runOctetCountedSyslog(l, done)
+
+	w, err := DialTLS(l.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, LOG_USER|LOG_INFO, "syslog_test")
+	if err != nil {
+		t.Fatalf("DialTLS() failed: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Info("first\nline"); err != nil {
+		t.Fatalf("log failed: %v", err)
+	}
+	got := <-done
+	if !strings.HasSuffix(got, "syslog_test["+fmt.Sprint(os.Getpid())+"]: first\nline") {
+		t.Errorf("got %q, want complete message without trailing newline", got)
+	}
+
+	// a lost connection is reestablished by the next write
+	w.Close()
+	if err := w.Info("second"); err != nil {
+		t.Fatalf("log after reconnect failed: %v", err)
+	}
+	if got := <-done; !strings.HasSuffix(got, ": second") {
+		t.Errorf("got %q after reconnect", got)
+	}
+}
+
+func TestDialTLSUnknownAuthority(t *testing.T) {
+	cert, _ := testCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go runOctetCountedSyslog(l, make(chan string))
+
+	_, otherCA := testCertificate(t)
+	if _, err := DialTLS(l.Addr().String(), &tls.Config{RootCAs: otherCA}, LOG_USER|LOG_INFO, "syslog_test"); err == nil {
+		t.Error("want error for untrusted server certificate, got nil")
+	}
+}
+
+func TestOctetCounting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan string)
+	go runOctetCountedSyslog(l, done)
+
+	w, err := Dial("tcp", l.Addr().String(), LOG_USER|LOG_INFO, "syslog_test")
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer w.Close()
+	w.SetFraming(FramingOctetCounting)
+
+	trace := "panic: oops\n\ngoroutine 1 [running]:\nmain.main()\n"
+	for _, msg := range []string{trace, "next"} {
+		if _, err := io.WriteString(w, msg); err != nil {
+			t.Fatalf("WriteString() failed: %v", err)
+		}
+	}
+	if got := <-done; !strings.HasSuffix(got, ": "+trace) {
+		t.Errorf("got %q, want complete stack trace", got)
+	}
+	if got := <-done; !strings.HasSuffix(got, ": next") {
+		t.Errorf("got %q, want next message", got)
+	}
+}
+
+func TestOctetCountingDatagram(t *testing.T) {
+	done := make(chan string)
+	addr, sock, _ := startServer("udp", "", done)
+	defer sock.Close()
+
+	w, err := Dial("udp", addr, LOG_USER|LOG_INFO, "syslog_test")
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer w.Close()
+	w.SetFraming(FramingOctetCounting)
+
+	if err := w.Info("write test"); err != nil {
+		t.Fatalf("log failed: %v", err)
+	}
+	check(t, "write test", <-done)
+}
+
+func TestParseFraming(t *testing.T) {
+	for s, want := range map[string]Framing{"newline": FramingNewline, "octet-counting": FramingOctetCounting} {
+		if got, err := ParseFraming(s); err != nil || got != want {
+			t.Errorf("ParseFraming(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseFraming("length"); err == nil {
+		t.Error("want error for unknown framing")
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	if p, err := ParseSeverity("Warning"); err != nil || p != LOG_WARNING {
+		t.Errorf("ParseSeverity(Warning) = %v, %v, want %v", p, err, LOG_WARNING)
+	}
+	if p, err := ParseFacility("local3"); err != nil || p != LOG_LOCAL3 {
+		t.Errorf("ParseFacility(local3) = %v, %v, want %v", p, err, LOG_LOCAL3)
+	}
+	if _, err := ParseSeverity("local3"); err == nil {
+		t.Error("want error for facility as severity")
+	}
+	if _, err := ParseFacility("warning"); err == nil {
+		t.Error("want error for severity as facility")
+	}
+}